@@ -0,0 +1,235 @@
+// Package clock lets the time be injected, so that whatever depends on it
+// can be run on a Fake clock in tests and simulations.
+package clock
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits for it like the time package does.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) *Timer
+	NewTicker(d time.Duration) *Ticker
+}
+
+// Timer is like time.Timer.
+type Timer struct {
+	C    <-chan time.Time
+	stop func() bool
+}
+
+// Stop prevents the timer from firing. It returns false if it has fired or
+// was stopped already.
+func (t *Timer) Stop() bool { return t.stop() }
+
+// Ticker is like time.Ticker.
+type Ticker struct {
+	C    <-chan time.Time
+	stop func()
+}
+
+func (t *Ticker) Stop() { t.stop() }
+
+// Real is the clock of the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) NewTimer(d time.Duration) *Timer {
+	t := time.NewTimer(d)
+	return &Timer{t.C, t.Stop}
+}
+
+func (realClock) NewTicker(d time.Duration) *Ticker {
+	t := time.NewTicker(d)
+	return &Ticker{t.C, t.Stop}
+}
+
+// WithTimeout is context.WithTimeout on the time of c.
+func WithTimeout(parent context.Context, c Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if c == Real {
+		return context.WithTimeout(parent, d)
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	tctx := &timeoutCtx{Context: ctx, deadline: c.Now().Add(d)}
+	t := c.NewTimer(d)
+	go func() {
+		select {
+		case <-t.C:
+			tctx.expire()
+			cancel()
+		case <-ctx.Done():
+			t.Stop()
+		}
+	}()
+	return tctx, cancel
+}
+
+// timeoutCtx is a context that reports context.DeadlineExceeded once the
+// deadline of its clock has passed.
+type timeoutCtx struct {
+	context.Context
+	deadline time.Time
+	expired  bool
+	mu       sync.Mutex
+}
+
+func (c *timeoutCtx) expire() {
+	c.mu.Lock()
+	c.expired = true
+	c.mu.Unlock()
+}
+
+func (c *timeoutCtx) Deadline() (time.Time, bool) { return c.deadline, true }
+
+func (c *timeoutCtx) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expired {
+		return context.DeadlineExceeded
+	}
+	return c.Context.Err()
+}
+
+// Fake is a Clock that stands still until it's advanced. Timers and tickers
+// fire as Advance passes their time, in order. Like those of the time
+// package, tickers drop ticks that aren't received in time.
+type Fake struct {
+	now     time.Time
+	waiters []*waiter
+	changed chan struct{}
+	mu      sync.Mutex
+}
+
+type waiter struct {
+	at     time.Time
+	period time.Duration // of tickers
+	c      chan time.Time
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now, changed: make(chan struct{})}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C
+}
+
+func (f *Fake) NewTimer(d time.Duration) *Timer {
+	w := f.add(d, 0)
+	return &Timer{w.c, func() bool { return f.remove(w) }}
+}
+
+// NewTicker panics if d isn't positive, like time.NewTicker.
+func (f *Fake) NewTicker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	w := f.add(d, d)
+	return &Ticker{w.c, func() { f.remove(w) }}
+}
+
+func (f *Fake) add(d, period time.Duration) *waiter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w := &waiter{at: f.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- f.now
+		return w
+	}
+	f.waiters = append(f.waiters, w)
+	f.sort()
+	f.notify()
+	return w
+}
+
+func (f *Fake) remove(w *waiter) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, o := range f.waiters {
+		if o == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			f.notify()
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the time forward by d, firing the timers and tickers on
+// the way.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	end := f.now.Add(d)
+	for len(f.waiters) > 0 && !f.waiters[0].at.After(end) {
+		w := f.waiters[0]
+		f.now = w.at
+		select {
+		case w.c <- f.now:
+		default:
+		}
+
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			f.waiters = f.waiters[1:]
+		}
+		f.sort()
+	}
+	f.now = end
+	f.notify()
+}
+
+// Waiters returns the number of timers and tickers that are yet to fire.
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+// BlockUntil waits until there are at least n timers and tickers yet to
+// fire. It lets tests advance the clock only once the goroutines they
+// started are waiting on it.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	for len(f.waiters) < n {
+		changed := f.changed
+		f.mu.Unlock()
+		<-changed
+		f.mu.Lock()
+	}
+	f.mu.Unlock()
+}
+
+// sort orders the waiters by the time they fire at. The caller must hold
+// mu.
+func (f *Fake) sort() {
+	sort.SliceStable(f.waiters, func(i, j int) bool {
+		return f.waiters[i].at.Before(f.waiters[j].at)
+	})
+}
+
+// notify wakes up BlockUntil. The caller must hold mu.
+func (f *Fake) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
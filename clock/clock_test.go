@@ -0,0 +1,93 @@
+package clock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFakeTimers(t *testing.T) {
+	start := time.Unix(0, 0)
+	f := NewFake(start)
+
+	t1 := f.NewTimer(time.Second)
+	t2 := f.After(2 * time.Second)
+	t3 := f.NewTimer(3 * time.Second)
+
+	f.Advance(time.Second)
+	select {
+	case now := <-t1.C:
+		if !now.Equal(start.Add(time.Second)) {
+			t.Fatalf("expected the timer to fire at 1s, got %v", now.Sub(start))
+		}
+	default:
+		t.Fatal("expected the first timer to fire")
+	}
+	select {
+	case <-t2:
+		t.Fatal("expected the second timer to wait")
+	default:
+	}
+
+	if !t3.Stop() {
+		t.Fatal("expected the third timer to be stopped")
+	}
+	f.Advance(time.Hour)
+	<-t2
+	select {
+	case <-t3.C:
+		t.Fatal("expected the stopped timer not to fire")
+	default:
+	}
+	if f.Waiters() != 0 {
+		t.Fatalf("expected no waiters, got %d", f.Waiters())
+	}
+	if f.Now() != start.Add(time.Hour+time.Second) {
+		t.Fatalf("expected the time to be 1h1s, got %v", f.Now().Sub(start))
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+	tk := f.NewTicker(time.Second)
+
+	ticks := 0
+	for i := 0; i < 10; i++ {
+		f.Advance(time.Second)
+		select {
+		case <-tk.C:
+			ticks++
+		default:
+		}
+	}
+	if ticks != 10 {
+		t.Fatalf("expected 10 ticks, got %d", ticks)
+	}
+
+	// Ticks that aren't received are dropped
+	f.Advance(10 * time.Second)
+	<-tk.C
+	select {
+	case <-tk.C:
+		t.Fatal("expected a single tick")
+	default:
+	}
+
+	tk.Stop()
+	if f.Waiters() != 0 {
+		t.Fatalf("expected no waiters, got %d", f.Waiters())
+	}
+}
+
+func TestFakeTimeout(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+	ctx, cancel := WithTimeout(context.Background(), f, time.Minute)
+	defer cancel()
+
+	f.BlockUntil(1)
+	f.Advance(time.Minute)
+	<-ctx.Done()
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", ctx.Err())
+	}
+}
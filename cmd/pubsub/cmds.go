@@ -2,8 +2,10 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"strings"
 	"time"
 	"github.com/Gaboose/go-pubsub/pnet/gway"
 	"github.com/Gaboose/go-pubsub/svice/ping"
@@ -36,8 +38,12 @@ var commands = CommandMap{
 Usage: pubsub [<flags>] <command> [ -help | <args> ] - p2p pubsub network
 
 COMMANDS:
+	bandwidth		Print the traffic by protocol and by peer
 	daemon			Run a network-connected pubsub node
+	gate			Print or change which peers may connect
+	peers			List the known peers
 	pub <topic> <msg>	Publish a message
+	shuffles		Print how the Cyclon shuffles went
 	sub <topic>		Listen for and receive messages
 
 FLAGS:
@@ -57,6 +63,17 @@ Usage: pubsub daemon [<flags>] - Run a network-connected PubSub node
 FLAGS:
 	-apiport	int	- Port for the daemon API to listen on
 	-swarmport	int	- Port to listen for other nodes on
+	-wsport	int	- Port to listen for other nodes on over websockets (0 to disable)
+	-utpport	int	- UDP port to listen for other nodes on over uTP (0 to disable)
+	-keyfile	string	- File to keep the node's identity in
+	-cachefile	string	- File to keep the known peers in between restarts
+	-saveinterval	duration	- How often to save the known peers
+	-muxers	string	- Comma separated stream muxers in order of preference
+	-hop	bool	- Relay streams for peers that can't reach each other
+	-relay	string	- Address of a relay to be reachable through, ending with /ipfs/<ID>
+	-lowconns	int	- Number of connections to trim down to
+	-highconns	int	- Number of connections to start trimming at (0 for no limit)
+	-gatefile	string	- File of allow and deny rules for peers and networks
 `,
 		Run: startDaemon,
 	},
@@ -70,6 +87,77 @@ FLAGS:
 		},
 	},
 		
+	"bandwidth": &RemoteCommand{
+		help: "Usage: pubsub bandwidth - Print the traffic by protocol and by peer",
+		Run: func(args []string, stdio io.ReadWriter) byte {
+			PrintBandwidth(stdio, daemon.Bandwidth())
+			return 0
+		},
+	},
+
+	"shuffles": &RemoteCommand{
+		help: "Usage: pubsub shuffles - Print how the Cyclon shuffles with other nodes went",
+		Run: func(args []string, stdio io.ReadWriter) byte {
+			PrintShuffleStats(stdio, daemon.ShuffleStats())
+			return 0
+		},
+	},
+
+	"gate": &RemoteCommand{
+		help: `
+Usage: pubsub gate [<command>] - Print or change the rules of which peers may connect
+
+COMMANDS:
+	allow|deny peer <ID>		Add a rule for a peer
+	allow|deny net <CIDR>		Add a rule for an IP network
+	remove <rule>			Remove a rule
+	load <file>			Replace the rules with those in a file
+
+Deny rules win. Once there's an allow rule for peers, only allowed peers may
+connect, and likewise for networks. Connections that aren't allowed anymore
+are closed.
+`,
+		Run: func(args []string, stdio io.ReadWriter) byte {
+			var err error
+			switch {
+			case len(args) == 0:
+				for _, r := range gater.Rules() {
+					fmt.Fprintln(stdio, r)
+				}
+				return 0
+			case args[0] == "load" && len(args) == 2:
+				err = LoadRules(args[1])
+			case args[0] == "remove":
+				var r gway.Rule
+				r, err = gway.ParseRule(strings.Join(args[1:], " "))
+				if err == nil && !gater.Remove(r) {
+					err = fmt.Errorf("no such rule: %v", r)
+				}
+			default:
+				var r gway.Rule
+				r, err = gway.ParseRule(strings.Join(args, " "))
+				if err == nil {
+					gater.Add(r)
+				}
+			}
+			if err != nil {
+				fmt.Fprintln(stdio, err)
+				return 1
+			}
+
+			daemon.CloseGated()
+			return 0
+		},
+	},
+
+	"peers": &RemoteCommand{
+		help: "Usage: pubsub peers - List the known peers with their addresses and latency",
+		Run: func(args []string, stdio io.ReadWriter) byte {
+			PrintPeers(stdio, daemon.Peerstore())
+			return 0
+		},
+	},
+
 	"ping": &LocalCommand{
 		help: "Usage: pubsub ping <maddr> - Try to contact a remote ping service",
 		Run: func(args []string, stdio io.ReadWriter) byte {
@@ -80,29 +168,23 @@ FLAGS:
 			}
 			
 			gw := gway.NewGateway()
+			defer gw.Close()
 			png := ping.Ping{ProtoNet: gw.NewProtoNet("/ping")}
 			p := &gway.PeerInfo{MAddrs: [][]byte{m.Bytes()}}
 			
-			stop := make(chan bool)
-			done := make(chan error)
-			
-			go func() {
-				done <- png.Ping(p, stop)
-			}()
-			
-			select {
-			case err = <-done:
-				if err != nil {
-					fmt.Fprintln(stdio, err)
-					return 1
-				}
-				fmt.Fprintln(stdio, "successful contact")
-				return 0
-			case <-time.After(5*time.Second):
-				close(stop)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			err = png.Ping(ctx, p)
+			if err == context.DeadlineExceeded {
 				fmt.Fprintln(stdio, "timed out")
 				return 1
+			} else if err != nil {
+				fmt.Fprintln(stdio, err)
+				return 1
 			}
+			fmt.Fprintln(stdio, "successful contact")
+			return 0
 		},
 	},
 
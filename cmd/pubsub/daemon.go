@@ -1,13 +1,25 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/Gaboose/go-pubsub/pnet/gway"
 	psnet "github.com/Gaboose/go-pubsub/net/cycbro"
+	"github.com/Gaboose/go-pubsub/pnet/peerstore"
+	"github.com/Gaboose/go-pubsub/svice/identify"
+	"github.com/Gaboose/go-pubsub/topo/broadcast"
+	"github.com/Gaboose/go-pubsub/topo/cyclon"
 
 	ma "github.com/jbenet/go-multiaddr"
 	manet "github.com/jbenet/go-multiaddr-net"
@@ -16,10 +28,29 @@ import (
 
 var daemon *psnet.Network
 
+// ShutdownTimeout bounds how long the daemon takes to shut down once it's
+// interrupted.
+var ShutdownTimeout = 10 * time.Second
+
+// gater holds the allow and deny rules of the daemon, which can be changed
+// with the gate command.
+var gater = gway.NewListGater()
+
 func startDaemon(args []string, stdio io.ReadWriter) byte {
 	fs := flag.NewFlagSet("pubsub daemon", flag.ContinueOnError)
 	apiport := fs.Int("apiport", 5002, "Port for the daemon API to listen on")
 	swarmport := fs.Int("swarmport", 4002, "Port to listen for other nodes on")
+	wsport := fs.Int("wsport", 0, "Port to listen for other nodes on over websockets (0 to disable)")
+	utpport := fs.Int("utpport", 0, "UDP port to listen for other nodes on over uTP (0 to disable)")
+	keyfile := fs.String("keyfile", "", "File to keep the node's identity in")
+	cachefile := fs.String("cachefile", "", "File to keep the known peers in between restarts")
+	saveinterval := fs.Duration("saveinterval", psnet.SaveInterval, "How often to save the known peers")
+	muxers := fs.String("muxers", "", "Comma separated stream muxers in order of preference")
+	hop := fs.Bool("hop", false, "Relay streams for peers that can't reach each other")
+	relayAddr := fs.String("relay", "", "Address of a relay to be reachable through, ending with /ipfs/<ID>")
+	lowconns := fs.Int("lowconns", 100, "Number of connections to trim down to")
+	highconns := fs.Int("highconns", 200, "Number of connections to start trimming at (0 for no limit)")
+	gatefile := fs.String("gatefile", "", "File of allow and deny rules for peers and networks")
 	err := fs.Parse(args)
 	if err != nil {
 		return 1
@@ -33,55 +64,127 @@ func startDaemon(args []string, stdio io.ReadWriter) byte {
 		return 1
 	}
 
-	err = network(*swarmport)
+	if *keyfile == "" {
+		*keyfile = DefaultKeyfile(*swarmport)
+	}
+	if *cachefile == "" {
+		*cachefile = DefaultCachefile(*swarmport)
+	}
+	psnet.Cachefile = *cachefile
+	psnet.SaveInterval = *saveinterval
+
+	muxs, err := ParseMuxers(*muxers)
 	if err != nil {
 		fmt.Println(err)
 		return 1
 	}
 
-	select {}
-}
+	var relay *gway.PeerInfo
+	if *relayAddr != "" {
+		relay, err = ParseRelay(*relayAddr)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
 
-func network(port int) error {
-	// Concatenating id with port allows us to run several
-	// daemons on the same machine
-	id, _ := os.Hostname()
-	id = fmt.Sprintf("%s.%d", id, port)
+	if *gatefile != "" {
+		err = LoadRules(*gatefile)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
 
-	ready := make(chan *psnet.Network)
+	if *highconns > 0 && *lowconns > *highconns {
+		fmt.Println("-lowconns can't be above -highconns")
+		return 1
+	}
 
+	ports := SwarmPorts{TCP: *swarmport, WS: *wsport, UTP: *utpport}
+	cfg := gway.Config{
+		Muxers:        muxs,
+		ConnLowWater:  *lowconns,
+		ConnHighWater: *highconns,
+		Gater:         gater,
+	}
+	// An interrupt while the network starts up cuts the wait for the
+	// bootstrap peers short, and shuts the node down right after
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	interrupted, interrupt := context.WithCancel(context.Background())
+	defer interrupt()
 	go func() {
-		// Look for peers to bootstrap our network with
-		peers := LookupMDNS()
+		<-sig
+		interrupt()
+	}()
 
-		// Advertise yourself on mDNS
-		PublishMDNS(id, port)
+	err = network(interrupted, ports, *keyfile, cfg, *hop, relay)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
 
-		n := <-ready
-		if n == nil {
-			return
-		}
+	<-interrupted.Done()
 
-		for _, p := range peers {
-			n.Connect(p)
-		}
-	}()
+	fmt.Println("Shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	err = daemon.Close(ctx)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func network(ctx context.Context, ports SwarmPorts, keyfile string, cfg gway.Config, hop bool, relay *gway.PeerInfo) error {
+	// Our peer ID is derived from a keypair, which we keep between restarts
+	ident, err := gway.LoadIdentity(keyfile)
+	if err != nil {
+		return err
+	}
+	id := ident.ID()
+	cfg.Identity = ident
+
+	// Look for peers to bootstrap our network with
+	peers := LookupMDNS()
+
+	// Advertise yourself on mDNS. Confirming our addresses below can take
+	// a while, and local peers needn't wait for it.
+	PublishMDNS(id, ports.TCP)
 
 	// Create our own PeerInfo
 	me := &gway.PeerInfo{
 		ID:     id,
-		MAddrs: BuildSwarmAddrs(port),
+		MAddrs: BuildSwarmAddrs(ports),
+	}
+	if relay != nil {
+		me.MAddrs = append(me.MAddrs, gway.CircuitAddr(relay)...)
 	}
 
-	// Start the network
-	n, err := psnet.NewNetwork(me)
+	// Start the network. It advertises only the addresses that our
+	// bootstrap peers could dial back, and waits for them until ctx is
+	// done at most.
+	n, err := psnet.NewNetwork(ctx, cfg, me, peers)
 	if err != nil {
-		ready <- nil
 		return err
 	}
+	if len(me.MAddrs) == 0 {
+		fmt.Println("No address could be dialed back, so none is advertised. Use -relay to be reachable through a relay.")
+	}
+
+	if hop {
+		n.ServeRelay()
+	}
+	if relay != nil {
+		err = n.UseRelay(relay)
+		if err != nil {
+			fmt.Println("Relay unavailable:", err)
+		}
+	}
 
 	daemon = n
-	ready <- n
 
 	return nil
 }
@@ -151,8 +254,16 @@ func apiServer(port int) error {
 	return nil
 }
 
+// SwarmPorts are the ports to listen for other nodes on, one per transport.
+// A zero port disables its transport, except for TCP.
+type SwarmPorts struct {
+	TCP int
+	WS  int
+	UTP int
+}
+
 // Builds and returns the Multiaddrs for the swarm to listen on
-func BuildSwarmAddrs(port int) [][]byte {
+func BuildSwarmAddrs(ports SwarmPorts) [][]byte {
 	// Get all interface addresses
 	all, _ := manet.InterfaceMultiaddrs()
 
@@ -168,19 +279,165 @@ func BuildSwarmAddrs(port int) [][]byte {
 		filtered = append(filtered, m)
 	}
 
-	// Add tcp/<port> to each address and convert to byte representation
-	prt, err := ma.NewMultiaddr(fmt.Sprintf("/tcp/%d", port))
-	if err != nil {
-		panic(err)
+	// Add tcp/<port> and the like to each address and convert to byte
+	// representation
+	suffixes := []string{fmt.Sprintf("/tcp/%d", ports.TCP)}
+	if ports.WS != 0 {
+		suffixes = append(suffixes, fmt.Sprintf("/tcp/%d/ws", ports.WS))
+	}
+	if ports.UTP != 0 {
+		suffixes = append(suffixes, fmt.Sprintf("/udp/%d/utp", ports.UTP))
 	}
 
 	var listenAddrs [][]byte
-	for _, a := range filtered {
-		listenAddrs = append(listenAddrs, a.Encapsulate(prt).Bytes())
+	for _, sfx := range suffixes {
+		prt, err := ma.NewMultiaddr(sfx)
+		if err != nil {
+			panic(err)
+		}
+		for _, a := range filtered {
+			listenAddrs = append(listenAddrs, a.Encapsulate(prt).Bytes())
+		}
 	}
 	return listenAddrs
 }
 
+// ParseMuxers splits a comma separated list of stream muxer names, as taken
+// by the -muxers flag. An empty list stands for gway.DefaultMuxers.
+func ParseMuxers(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	muxers := strings.Split(list, ",")
+	for _, m := range muxers {
+		if _, ok := gway.Muxers[m]; !ok {
+			return nil, fmt.Errorf("unknown stream muxer %s", m)
+		}
+	}
+	return muxers, nil
+}
+
+// ParseRelay reads the address of a relay, as taken by the -relay flag, e.g.
+// /ip4/1.2.3.4/tcp/4002/ipfs/<ID>.
+func ParseRelay(s string) (*gway.PeerInfo, error) {
+	_, err := ma.NewMultiaddr(s)
+	if err != nil {
+		return nil, err
+	}
+
+	i := strings.LastIndex(s, "/ipfs/")
+	if i < 1 {
+		return nil, fmt.Errorf("relay address %s has no /ipfs/<ID> at the end", s)
+	}
+
+	return &gway.PeerInfo{
+		ID:     s[i+len("/ipfs/"):],
+		MAddrs: [][]byte{ma.StringCast(s[:i]).Bytes()},
+	}, nil
+}
+
+// PrintPeers writes what the peerstore knows about each peer to w.
+func PrintPeers(w io.Writer, pstore *peerstore.Peerstore) {
+	ids := pstore.Peers()
+	sort.Strings(ids)
+	for _, id := range ids {
+		fmt.Fprintln(w, id)
+		if l := pstore.Latency(id); l > 0 {
+			fmt.Fprintf(w, "\tlatency\t%v\n", l)
+		}
+		if agent := pstore.Get(id, identify.AgentKey); agent != nil {
+			fmt.Fprintf(w, "\tagent\t%v\n", agent)
+		}
+		if pstore.Get(id, broadcast.NeighbourKey) == true {
+			fmt.Fprintln(w, "\tbroadcast neighbour")
+		}
+		for _, bts := range pstore.Addrs(id) {
+			m, err := ma.NewMultiaddrBytes(bts)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "\taddr\t%v\n", m)
+		}
+		for _, proto := range pstore.Protocols(id) {
+			fmt.Fprintf(w, "\tproto\t%v\n", proto)
+		}
+	}
+}
+
+// PrintBandwidth writes the totals and rates of a bandwidth report to w,
+// by protocol and by peer.
+func PrintBandwidth(w io.Writer, r gway.BandwidthReport) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	defer tw.Flush()
+
+	line := func(name string, s gway.BandwidthStats) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%.1f\n", name, s.TotalIn, s.TotalOut, s.RateIn, s.RateOut)
+	}
+	section := func(title string, stats map[string]gway.BandwidthStats) {
+		names := make([]string, 0, len(stats))
+		for name := range stats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintf(tw, "\n%s\t\t\t\t\n", title)
+		for _, name := range names {
+			line(name, stats[name])
+		}
+	}
+
+	fmt.Fprintln(tw, "\tIN (B)\tOUT (B)\tIN (B/s)\tOUT (B/s)")
+	line("total", r.Total)
+	section("PROTOCOLS", r.Protocols)
+	section("PEERS", r.Peers)
+}
+
+// PrintShuffleStats writes the counts of the Cyclon shuffles to w.
+func PrintShuffleStats(w io.Writer, s cyclon.ShuffleStats) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	defer tw.Flush()
+
+	fmt.Fprintf(tw, "succeeded\t%d\n", s.Succeeded)
+	fmt.Fprintf(tw, "failed\t%d\n", s.Failed)
+	fmt.Fprintf(tw, "retries\t%d\n", s.Retries)
+	fmt.Fprintf(tw, "dropped\t%d\n", s.Dropped)
+	fmt.Fprintf(tw, "timed out\t%d\n", s.TimedOut)
+}
+
+// LoadRules replaces the rules of the daemon's gater with those in a file.
+func LoadRules(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rules, err := gway.ReadRules(f)
+	if err != nil {
+		return err
+	}
+	gater.Set(rules)
+	return nil
+}
+
+// DefaultKeyfile returns where the identity of a daemon is kept unless
+// specified otherwise. Including the port allows us to run several daemons
+// on the same machine.
+func DefaultKeyfile(port int) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return filepath.Join(home, ".pubsub", fmt.Sprintf("identity.%d", port))
+}
+
+// DefaultCachefile is where the daemon listening on port keeps the peers
+// it knows, next to its identity.
+func DefaultCachefile(port int) string {
+	return filepath.Join(filepath.Dir(DefaultKeyfile(port)), fmt.Sprintf("cache.%d", port))
+}
+
 func BuildAPIAddr(port int) ma.Multiaddr {
 	return manet.IP4Loopback.Encapsulate(
 		ma.StringCast(fmt.Sprint("/tcp/", port)))
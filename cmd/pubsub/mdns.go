@@ -16,9 +16,10 @@ func init() {
 	mdns.Log.SetOutput(ioutil.Discard)
 }
 
-func PublishMDNS(host string, port int) {
-	info := fmt.Sprintf("go-pubsub(%s)", host)
-	service, _ := mdns.NewMDNSService(host, ServiceTag, "", "", port, nil, []string{info})
+// PublishMDNS advertises our peer ID and port on the local network.
+// LookupMDNS reads the ID back from the TXT record.
+func PublishMDNS(id string, port int) {
+	service, _ := mdns.NewMDNSService(id, ServiceTag, "", "", port, nil, []string{id})
 
 	// Create and run the mDNS server, don't shudown
 	mdns.NewServer(&mdns.Config{Zone: service})
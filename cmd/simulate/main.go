@@ -0,0 +1,65 @@
+// Command simulate plays a scenario of joins, churn and failures on an
+// overlay of simulated Cyclon and broadcast nodes, and prints how the
+// overlay looks after every step.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Gaboose/go-pubsub/sim"
+)
+
+func main() {
+	cfg := sim.DefaultConfig
+	nodes := flag.Int("nodes", 1000, "Number of nodes to join")
+	rounds := flag.Int("rounds", 20, "Shuffle rounds after every step")
+	churn := flag.Float64("churn", 0.05, "Share of the nodes replaced every round of churn")
+	fail := flag.Float64("fail", 0.5, "Share of the nodes killed at once")
+	msgs := flag.Int("msgs", 10, "Messages broadcast after every step")
+	flag.IntVar(&cfg.CacheSize, "cachesize", cfg.CacheSize, "Cyclon cache size")
+	flag.IntVar(&cfg.ShufLen, "shuflen", cfg.ShufLen, "Cyclon shuffle length")
+	flag.IntVar(&cfg.Fanout, "fanout", cfg.Fanout, "Broadcast fanout")
+	flag.IntVar(&cfg.BackupSize, "backup", cfg.BackupSize, "Broadcast backup size")
+	flag.DurationVar(&cfg.Link.Latency, "latency", cfg.Link.Latency, "Latency of every link")
+	flag.Float64Var(&cfg.Link.Loss, "loss", cfg.Link.Loss, "Probability of a dropped write or dial")
+	flag.Int64Var(&cfg.Seed, "seed", cfg.Seed, "Random seed")
+	flag.Parse()
+
+	s := sim.New(cfg)
+	defer s.Close()
+
+	steps := []sim.Step{
+		sim.JoinWave(*nodes, *rounds),
+		sim.Churn(int(*churn*float64(*nodes)), *rounds),
+		sim.MassFailure(*fail, *rounds),
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "step\tnodes\tin-degree\tdead\tclustering\tpath\tparts\treliability\tp50\tp90\tp99\ttook")
+	for _, r := range s.Play(steps, *msgs) {
+		fmt.Fprintf(w, "%s\t%d\t%.1f±%.1f\t%d\t%.3f\t%.2f\t%d\t%.3f\t%v\t%v\t%v\t%v\n",
+			r.Step, r.Nodes, r.InDegreeMean, r.InDegreeStdDev, r.DeadLinks,
+			r.Clustering, r.PathLength, r.Partitions, r.Broadcast.Reliability,
+			r.Broadcast.P50, r.Broadcast.P90, r.Broadcast.P99,
+			r.Took.Round(time.Millisecond))
+	}
+	w.Flush()
+
+	// The in-degree distribution after the last step
+	last := s.Measure()
+	degrees := make([]int, 0, len(last.InDegree))
+	for d := range last.InDegree {
+		degrees = append(degrees, d)
+	}
+	sort.Ints(degrees)
+	fmt.Println()
+	fmt.Println("in-degree\tnodes")
+	for _, d := range degrees {
+		fmt.Printf("%d\t%d\n", d, last.InDegree[d])
+	}
+}
@@ -1,17 +1,48 @@
 package net
 
 import (
+	"context"
 	"encoding/gob"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Gaboose/go-pubsub/pnet/gway"
+	"github.com/Gaboose/go-pubsub/pnet/peerstore"
 	"github.com/Gaboose/go-pubsub/topo/broadcast"
 	"github.com/Gaboose/go-pubsub/topo/cyclon"
     "github.com/Gaboose/go-pubsub/svice/ping"
 
 	ps "github.com/briantigerchow/pubsub"
+	"github.com/ipfs/go-ipfs/thirdparty/multierr"
+)
+
+// RelayTimeout bounds how long UseRelay takes to connect.
+var RelayTimeout = 10 * time.Second
+
+// RelayCheckInterval is how often a node checks that it's still connected
+// with the relays it uses, and reconnects if it isn't.
+var RelayCheckInterval = 30 * time.Second
+
+// ReachabilityTimeout bounds how long NewNetwork waits for the bootstrap
+// peers to dial it back, unless its ctx is done sooner.
+var ReachabilityTimeout = 15 * time.Second
+
+// Parameters of Cyclon and broadcast, as in cyclon.New, broadcast.New and
+// Broadcast.Start. The sim package measures how they shape the overlay.
+var (
+	CacheSize  = 30
+	ShufLen    = 10
+	Fanout     = 2
+	BackupSize = 30
+)
+
+// Cachefile, if it's set, is where the Cyclon cache is kept between
+// restarts. It's saved every SaveInterval and when the node closes.
+var (
+	Cachefile    string
+	SaveInterval = time.Minute
 )
 
 type Network struct {
@@ -19,40 +50,182 @@ type Network struct {
 	cyc *cyclon.Cyclon
 	bro *broadcast.Broadcast
 	rtr *ps.PubSub
+
+	relays   []chan bool // stop the reconnecting to each relay
+	relaysmu sync.Mutex
 }
 
-func NewNetwork(me *gway.PeerInfo) (*Network, error) {
-	gw := gway.NewGateway()
+// NewNetwork starts a node. The bootstrap peers are the first ones it gets
+// to know. They're also asked which of me.MAddrs they can dial back, and
+// only those are advertised from then on, along with relayed ones. Waiting
+// for their answers stops when ctx is done, and me is left alone then.
+func NewNetwork(ctx context.Context, cfg gway.Config, me *gway.PeerInfo, bootstrap []*gway.PeerInfo) (*Network, error) {
+	gw := gway.NewGatewayConfig(cfg)
 	err := gw.ListenAll(me.MAddrs)
 	if err != nil {
+		gw.Close()
 		return nil, err
 	}
 
 	gob.Register(&gway.PeerInfo{})
     
     (&ping.Ping{ProtoNet: gw.NewProtoNet("/ping")}).Serve()
+	gw.NewAutoNAT().Serve()
+
+	if len(bootstrap) > 0 {
+		confirmAddrs(ctx, gw, me, bootstrap)
+	}
 
-	c := cyclon.New(me, 30, 10, gw.NewProtoNet("/cyclon"))
+	c := cyclon.New(me, CacheSize, ShufLen, gw.NewProtoNetMatch(cyclon.Proto, gway.SemverMatch(cyclon.Proto)))
+	c.Cachefile = Cachefile
+	c.SaveInterval = SaveInterval
 	c.Start(time.Second)
 
-	b := broadcast.New(2, time.Minute, gw.NewProtoNet("/broadcast"))
-	b.Start(c.Out(), 30)
+	b := broadcast.New(Fanout, time.Minute, gw.NewProtoNetMatch(broadcast.Proto, gway.SemverMatch(broadcast.Proto)))
+	b.Start(c.Out(), BackupSize)
 
 	r := ps.New(1)
-	go route(b.Out(), r)
+	go route(b.Out(), b.Stopped(), r)
 
-	return &Network{
+	n := &Network{
 		gw:  gw,
 		cyc: c,
 		bro: b,
 		rtr: r,
-	}, nil
+	}
+	for _, p := range bootstrap {
+		n.Connect(p)
+	}
+	return n, nil
+}
+
+// confirmAddrs leaves only those of me's addresses that servers could dial
+// back, and the relayed ones. If none of the servers answer, me is left
+// alone.
+func confirmAddrs(ctx context.Context, gw *gway.Gateway, me *gway.PeerInfo, servers []*gway.PeerInfo) {
+	ctx, cancel := context.WithTimeout(ctx, ReachabilityTimeout)
+	defer cancel()
+
+	err := gw.CheckReachability(ctx, servers, me.MAddrs)
+	if err != nil {
+		fmt.Println("Reachability unknown:", err)
+		return
+	}
+
+	addrs := gw.ConfirmedAddrs()
+	for _, bts := range me.MAddrs {
+		if gway.IsCircuit(bts) {
+			addrs = append(addrs, bts)
+		}
+	}
+	me.MAddrs = addrs
+
+	fmt.Printf("Reachability: %v, %d addresses confirmed\n", gw.Reachability(), len(gw.ConfirmedAddrs()))
+}
+
+// Connect joins the overlay through p in the background. The random walks
+// of a join can take a while, see cyclon.WalkLength.
+func (n *Network) Connect(p *gway.PeerInfo) {
+	n.gw.Peerstore().AddAddrs(p.ID, p.MAddrs, peerstore.PermanentAddrTTL)
+	go func() {
+		err := n.cyc.Join(p)
+		if err != nil {
+			fmt.Printf("Joining through %s: %v\n", p.ID, err)
+		}
+	}()
 }
 
-func (n *Network) Connect(p *gway.PeerInfo) { n.cyc.Add(p) }
+// CloseGated closes the connections that the gater of the node's config
+// refuses now.
+func (n *Network) CloseGated() { n.gw.CloseGated() }
+
+// Bandwidth reports the traffic of the node by protocol and by peer.
+func (n *Network) Bandwidth() gway.BandwidthReport { return n.gw.Bandwidth() }
+
+// ShuffleStats counts how the Cyclon shuffles of the node went.
+func (n *Network) ShuffleStats() cyclon.ShuffleStats { return n.cyc.Stats() }
+
+// Peerstore returns what the node knows about other peers.
+func (n *Network) Peerstore() *peerstore.Peerstore { return n.gw.Peerstore() }
 
+// ServeRelay makes this node forward streams for peers that can't reach
+// each other directly.
+func (n *Network) ServeRelay() { n.gw.NewRelay().Serve() }
+
+// UseRelay connects to the relay r and stays connected, so that peers can
+// reach us through it. The connection is checked every RelayCheckInterval
+// and reopened in the background if it's lost, or if this first attempt
+// fails, in which case its error is returned.
+func (n *Network) UseRelay(r *gway.PeerInfo) error {
+	n.gw.Protect(r.ID, "relay")
+	err := n.connectRelay(r)
+
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(RelayCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := n.connectRelay(r); err != nil {
+					fmt.Println("Relay unavailable:", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	n.relaysmu.Lock()
+	n.relays = append(n.relays, stop)
+	n.relaysmu.Unlock()
+	return err
+}
+
+// connectRelay connects to the relay r, unless it's connected already.
+func (n *Network) connectRelay(r *gway.PeerInfo) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RelayTimeout)
+	defer cancel()
+	return n.gw.Connect(ctx, r)
+}
+
+// Close shuts the node down in order: it stops reconnecting to its relays and
+// accepting connections, lets the broadcasts in flight reach the neighbours,
+// stops broadcast and Cyclon, and closes the connections. Whatever is left
+// when ctx is done is cut short and counted as a failure.
+func (n *Network) Close(ctx context.Context) error {
+	retErr := multierr.New()
+	addErr := func(err error) {
+		if err != nil {
+			retErr.Errors = append(retErr.Errors, err)
+		}
+	}
+
+	n.relaysmu.Lock()
+	for _, stop := range n.relays {
+		close(stop)
+	}
+	n.relays = nil
+	n.relaysmu.Unlock()
+
+	addErr(n.gw.CloseListeners())
+	addErr(n.bro.Close(ctx))
+	addErr(n.cyc.Close(ctx))
+	addErr(n.gw.Shutdown(ctx))
+	n.rtr.Shutdown()
+
+	if retErr.Errors != nil {
+		return retErr
+	}
+	return nil
+}
+
+// Pub broadcasts msg on topic. Once the network is closed, it does nothing.
 func (n *Network) Pub(msg string, topic string) {
-	n.bro.In() <- fmt.Sprintf("/%s/%s", topic, msg)
+	select {
+	case n.bro.In() <- fmt.Sprintf("/%s/%s", topic, msg):
+	case <-n.bro.Stopped():
+	}
 }
 
 func (n *Network) Sub(topic string) (<-chan interface{}, chan<- bool) {
@@ -65,9 +238,16 @@ func (n *Network) Sub(topic string) (<-chan interface{}, chan<- bool) {
 	return ch, unsub
 }
 
-func route(in <-chan string, rtr *ps.PubSub) {
+// route publishes the messages from in on their topics, until stop is
+// closed.
+func route(in <-chan string, stop <-chan bool, rtr *ps.PubSub) {
 	for {
-		msg := string(<-in)
+		var msg string
+		select {
+		case msg = <-in:
+		case <-stop:
+			return
+		}
 		if strings.Count(msg, "/") < 2 || msg[0] != '/' {
 			fmt.Println("Unspecified topic")
 			continue
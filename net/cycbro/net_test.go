@@ -0,0 +1,60 @@
+package net
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/go-pubsub/pnet/gway"
+	"github.com/Gaboose/go-pubsub/topo/broadcast"
+)
+
+func TestMemory(t *testing.T) {
+	id1, err := gway.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	me1 := &gway.PeerInfo{ID: id1.ID(), MAddrs: [][]byte{gway.MemoryAddr("cycbro1")}}
+	n1, err := NewNetwork(context.Background(), gway.Config{Identity: id1}, me1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n1.Close(context.Background())
+
+	id2, err := gway.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	me2 := &gway.PeerInfo{ID: id2.ID(), MAddrs: [][]byte{gway.MemoryAddr("cycbro2")}}
+	n2, err := NewNetwork(context.Background(), gway.Config{Identity: id2}, me2, []*gway.PeerInfo{me1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n2.Close(context.Background())
+
+	// n1 dialed n2 back at its memory address
+	if len(me2.MAddrs) != 1 {
+		t.Fatalf("expected the memory address to be confirmed, got %d addresses", len(me2.MAddrs))
+	}
+
+	// They become each other's broadcast neighbours
+	deadline := time.Now().Add(5 * time.Second)
+	for n1.Peerstore().Get(me2.ID, broadcast.NeighbourKey) != true ||
+		n2.Peerstore().Get(me1.ID, broadcast.NeighbourKey) != true {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the nodes to become neighbours")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// and what one publishes reaches the other
+	before := n1.Bandwidth().Protocols[broadcast.Proto].TotalIn
+	n2.Pub("hello", "test")
+	deadline = time.Now().Add(5 * time.Second)
+	for n1.Bandwidth().Protocols[broadcast.Proto].TotalIn == before {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the message to reach n1")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
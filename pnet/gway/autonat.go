@@ -0,0 +1,121 @@
+package gway
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Gaboose/go-pubsub/pnet"
+	"github.com/Gaboose/go-pubsub/svice/autonat"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+// NewAutoNAT returns an autonat service on top of this gateway. Serve it to
+// dial other peers back on request.
+func (gw *Gateway) NewAutoNAT() *autonat.AutoNAT {
+	return &autonat.AutoNAT{
+		ProtoNet: gw.NewProtoNet(autonat.Proto),
+		Prober:   gw,
+	}
+}
+
+// Probe dials the peer id at addr over a new connection, which is closed
+// as soon as the peer authenticates. Relayed addresses aren't probed,
+// because the relay is what answers them.
+func (gw *Gateway) Probe(ctx context.Context, id string, addr []byte) error {
+	m, err := parseAddr(addr)
+	if err != nil {
+		return err
+	}
+	if _, _, ok := splitCircuit(m); ok {
+		return errors.New("won't probe a relayed address")
+	}
+
+	nc, err := gw.dialNet(ctx, m, id)
+	if err != nil {
+		return err
+	}
+	ac, err := gw.upgrade(ctx, nc, id, false)
+	if err != nil {
+		nc.Close()
+		return err
+	}
+	return ac.Close()
+}
+
+// SameHost tells whether addr has the IP address of observed. Memory
+// addresses are all on the same host, and so are nowhere else.
+func (gw *Gateway) SameHost(observed, addr []byte) bool {
+	mo, err := parseAddr(observed)
+	if err != nil {
+		return false
+	}
+	m, err := parseAddr(addr)
+	if err != nil {
+		return false
+	}
+
+	_, okO := memoryName(mo)
+	_, ok := memoryName(m)
+	if okO || ok {
+		return okO && ok
+	}
+	ipO, ip := hostIP(mo), hostIP(m)
+	return ipO != nil && ip != nil && ipO.Equal(ip)
+}
+
+// hostIP returns the IP address that m starts with, or nil if it doesn't
+// start with one.
+func hostIP(m ma.Multiaddr) ma.Multiaddr {
+	parts := ma.Split(m)
+	if len(parts) == 0 {
+		return nil
+	}
+	switch parts[0].Protocols()[0].Code {
+	case ma.P_IP4, ma.P_IP6:
+		return parts[0]
+	}
+	return nil
+}
+
+// CheckReachability asks servers, which run the autonat service, to dial
+// us back at addrs. Relayed addresses are left out. The outcome is kept
+// for Reachability and ConfirmedAddrs, unless no server answers.
+func (gw *Gateway) CheckReachability(ctx context.Context, servers []*PeerInfo, addrs [][]byte) error {
+	var direct [][]byte
+	for _, bts := range addrs {
+		if !IsCircuit(bts) {
+			direct = append(direct, bts)
+		}
+	}
+
+	peers := make([]pnet.Peer, len(servers))
+	for i, s := range servers {
+		peers[i] = s
+	}
+
+	res, err := autonat.Check(ctx, gw.NewProtoDialer(autonat.Proto), peers, gw.ID(), direct)
+	if err != nil {
+		return err
+	}
+
+	gw.natmu.Lock()
+	gw.nat = res
+	gw.natmu.Unlock()
+	return nil
+}
+
+// Reachability tells whether we can be dialed from outside, as found out
+// by the last CheckReachability.
+func (gw *Gateway) Reachability() autonat.Reachability {
+	gw.natmu.Lock()
+	defer gw.natmu.Unlock()
+	return gw.nat.Reachability
+}
+
+// ConfirmedAddrs returns the addresses that were dialed back during the
+// last CheckReachability.
+func (gw *Gateway) ConfirmedAddrs() [][]byte {
+	gw.natmu.Lock()
+	defer gw.natmu.Unlock()
+	return append([][]byte(nil), gw.nat.Confirmed...)
+}
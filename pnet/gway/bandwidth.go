@@ -0,0 +1,234 @@
+package gway
+
+import (
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	ps "github.com/jbenet/go-peerstream"
+)
+
+// RateInterval is how often the moving averages of transfer rates take a
+// sample. RateHalfLife is how long it takes a sample to lose half its weight.
+var (
+	RateInterval = time.Second
+	RateHalfLife = 10 * time.Second
+)
+
+// BandwidthStats of a protocol, a peer or the whole gateway. Totals are in
+// bytes, rates in bytes per second.
+type BandwidthStats struct {
+	TotalIn  int64
+	TotalOut int64
+	RateIn   float64
+	RateOut  float64
+}
+
+// BandwidthReport is a snapshot of the traffic that went through the
+// streams of a gateway.
+type BandwidthReport struct {
+	Total     BandwidthStats
+	Protocols map[string]BandwidthStats
+	Peers     map[string]BandwidthStats
+}
+
+// meter counts bytes and keeps an exponential moving average of their
+// rate. The average is brought up to date lazily, whenever the meter is
+// used.
+type meter struct {
+	total     int64
+	lastTotal int64
+	lastTick  time.Time
+	rate      float64
+}
+
+func (m *meter) mark(n int, now time.Time) {
+	m.tick(now)
+	m.total += int64(n)
+}
+
+func (m *meter) tick(now time.Time) {
+	if m.lastTick.IsZero() {
+		m.lastTick = now
+		return
+	}
+
+	elapsed := now.Sub(m.lastTick)
+	if elapsed < RateInterval {
+		return
+	}
+
+	sample := float64(m.total-m.lastTotal) / elapsed.Seconds()
+	alpha := 1 - math.Pow(0.5, float64(elapsed)/float64(RateHalfLife))
+	m.rate = alpha*sample + (1-alpha)*m.rate
+	m.lastTotal = m.total
+	m.lastTick = now
+}
+
+type meters struct {
+	in, out meter
+}
+
+func (ms *meters) stats(now time.Time) BandwidthStats {
+	ms.in.tick(now)
+	ms.out.tick(now)
+	return BandwidthStats{
+		TotalIn:  ms.in.total,
+		TotalOut: ms.out.total,
+		RateIn:   ms.in.rate,
+		RateOut:  ms.out.rate,
+	}
+}
+
+// bandwidth aggregates the traffic of streams by protocol and by peer.
+type bandwidth struct {
+	total  meters
+	protos map[string]*meters
+	peers  map[string]*meters
+	mu     sync.Mutex
+}
+
+func newBandwidth() *bandwidth {
+	return &bandwidth{
+		protos: make(map[string]*meters),
+		peers:  make(map[string]*meters),
+	}
+}
+
+func (bw *bandwidth) record(proto, peer string, n int, in bool) {
+	if n <= 0 {
+		return
+	}
+
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	pr, ok := bw.protos[proto]
+	if !ok {
+		pr = &meters{}
+		bw.protos[proto] = pr
+	}
+	pe, ok := bw.peers[peer]
+	if !ok {
+		pe = &meters{}
+		bw.peers[peer] = pe
+	}
+
+	now := time.Now()
+	for _, ms := range []*meters{&bw.total, pr, pe} {
+		if in {
+			ms.in.mark(n, now)
+		} else {
+			ms.out.mark(n, now)
+		}
+	}
+}
+
+// forgetPeer drops the meters of peer, once it has no connections left.
+// Its traffic stays counted in the totals and by protocol.
+func (gw *Gateway) forgetPeer(c *ps.Conn) {
+	mc, ok := c.Conn().(*muxConn)
+	if !ok || gw.connected(mc.remoteID) {
+		return
+	}
+	gw.bw.mu.Lock()
+	delete(gw.bw.peers, mc.remoteID)
+	gw.bw.mu.Unlock()
+}
+
+// Bandwidth reports how much traffic went through the streams of the
+// gateway's ProtoNets, in total, by protocol and by peer.
+func (gw *Gateway) Bandwidth() BandwidthReport {
+	bw := gw.bw
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	now := time.Now()
+	r := BandwidthReport{
+		Total:     bw.total.stats(now),
+		Protocols: make(map[string]BandwidthStats, len(bw.protos)),
+		Peers:     make(map[string]BandwidthStats, len(bw.peers)),
+	}
+	for proto, ms := range bw.protos {
+		r.Protocols[proto] = ms.stats(now)
+	}
+	for peer, ms := range bw.peers {
+		r.Peers[peer] = ms.stats(now)
+	}
+	return r
+}
+
+// BandwidthForProtocol reports the traffic of a single protocol.
+func (gw *Gateway) BandwidthForProtocol(proto string) BandwidthStats {
+	bw := gw.bw
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	ms, ok := bw.protos[proto]
+	if !ok {
+		return BandwidthStats{}
+	}
+	return ms.stats(time.Now())
+}
+
+// BandwidthForPeer reports the traffic with a single peer.
+func (gw *Gateway) BandwidthForPeer(id string) BandwidthStats {
+	bw := gw.bw
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	ms, ok := bw.peers[id]
+	if !ok {
+		return BandwidthStats{}
+	}
+	return ms.stats(time.Now())
+}
+
+// meteredStream counts the bytes that go through a stream of proto. It
+// also remembers which peer the stream is with, and where from.
+type meteredStream struct {
+	io.ReadWriteCloser
+	proto string
+	peer  string
+	addr  []byte
+	bw    *bandwidth
+}
+
+// meterStream wraps rwc, a stream that proto was selected on, so that its
+// traffic is accounted for.
+func (gw *Gateway) meterStream(rwc io.ReadWriteCloser, proto string) io.ReadWriteCloser {
+	var peer string
+	var addr []byte
+	if s, ok := rwc.(*ps.Stream); ok {
+		if mc, ok := s.Conn().Conn().(*muxConn); ok {
+			peer = mc.remoteID
+		}
+		if m := remoteMultiaddr(s.Conn().NetConn()); m != nil {
+			addr = m.Bytes()
+		}
+	}
+	return &meteredStream{rwc, proto, peer, addr, gw.bw}
+}
+
+// Protocol returns the protocol that was negotiated on the stream.
+func (s *meteredStream) Protocol() string { return s.proto }
+
+// RemotePeer returns the ID that the peer on the other end authenticated
+// with.
+func (s *meteredStream) RemotePeer() interface{} { return s.peer }
+
+// ObservedAddr returns the remote address of the stream's connection.
+func (s *meteredStream) ObservedAddr() []byte { return s.addr }
+
+func (s *meteredStream) Read(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Read(p)
+	s.bw.record(s.proto, s.peer, n, true)
+	return n, err
+}
+
+func (s *meteredStream) Write(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Write(p)
+	s.bw.record(s.proto, s.peer, n, false)
+	return n, err
+}
@@ -0,0 +1,34 @@
+package gway
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeterRate(t *testing.T) {
+	var m meter
+	now := time.Unix(0, 0)
+	m.mark(0, now)
+
+	// A steady 1000 B/s should pull the average towards it
+	for i := 0; i < 100; i++ {
+		now = now.Add(time.Second)
+		m.mark(1000, now)
+	}
+	now = now.Add(time.Second)
+	m.tick(now)
+
+	if m.total != 100000 {
+		t.Fatalf("expected 100000 bytes, got %d", m.total)
+	}
+	if m.rate < 990 || m.rate > 1010 {
+		t.Fatalf("expected a rate of about 1000, got %f", m.rate)
+	}
+
+	// And an idle minute should bring it close to zero
+	now = now.Add(time.Minute)
+	m.tick(now)
+	if m.rate > 20 {
+		t.Fatalf("expected the rate to decay, got %f", m.rate)
+	}
+}
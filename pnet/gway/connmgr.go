@@ -0,0 +1,166 @@
+package gway
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	ps "github.com/jbenet/go-peerstream"
+)
+
+// ConnGracePeriod is how long a new connection is safe from trimming, so
+// that it has a chance to be used.
+var ConnGracePeriod = 30 * time.Second
+
+// connManager keeps the number of connections between the watermarks of
+// the gateway's Config.
+type connManager struct {
+	opened    map[*ps.Conn]time.Time
+	protected map[string]map[string]bool // peer ID to tags
+	trimming  bool
+	mu        sync.Mutex
+}
+
+func newConnManager() *connManager {
+	return &connManager{
+		opened:    make(map[*ps.Conn]time.Time),
+		protected: make(map[string]map[string]bool),
+	}
+}
+
+// Protect keeps the connections with the peer id from being trimmed until
+// it's unprotected with the same tag. Tags let several users protect the
+// same peer independently.
+func (gw *Gateway) Protect(id, tag string) {
+	cm := gw.cm
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	tags, ok := cm.protected[id]
+	if !ok {
+		tags = make(map[string]bool)
+		cm.protected[id] = tags
+	}
+	tags[tag] = true
+}
+
+// Unprotect removes the protection of id under tag. It returns whether id is
+// still protected under other tags.
+func (gw *Gateway) Unprotect(id, tag string) bool {
+	cm := gw.cm
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	tags := cm.protected[id]
+	delete(tags, tag)
+	if len(tags) == 0 {
+		delete(cm.protected, id)
+		return false
+	}
+	return true
+}
+
+// IsProtected tells if id is protected under any tag.
+func (gw *Gateway) IsProtected(id string) bool {
+	gw.cm.mu.Lock()
+	defer gw.cm.mu.Unlock()
+	return len(gw.cm.protected[id]) > 0
+}
+
+// connOpened starts tracking c and trims the connections in the background
+// if there are too many. Without a limit, there's nothing to track.
+func (gw *Gateway) connOpened(c *ps.Conn) {
+	if gw.cfg.ConnHighWater <= 0 {
+		return
+	}
+
+	cm := gw.cm
+	cm.mu.Lock()
+	cm.opened[c] = time.Now()
+	cm.mu.Unlock()
+
+	if len(gw.conns.Conns()) > gw.cfg.ConnHighWater {
+		go gw.TrimConns()
+	}
+}
+
+// connClosed stops tracking c. Connections that close before they're
+// tracked are forgotten by the next trim.
+func (gw *Gateway) connClosed(c *ps.Conn) {
+	cm := gw.cm
+	cm.mu.Lock()
+	delete(cm.opened, c)
+	cm.mu.Unlock()
+}
+
+// TrimConns closes connections until no more than Config.ConnLowWater are
+// left. Connections with protected peers or younger than ConnGracePeriod are
+// kept. Of the rest, those without open streams go first, then the oldest.
+// It does nothing if Config.ConnHighWater is 0 or a trim is underway.
+func (gw *Gateway) TrimConns() {
+	if gw.cfg.ConnHighWater <= 0 {
+		return
+	}
+
+	cm := gw.cm
+	cm.mu.Lock()
+	if cm.trimming {
+		cm.mu.Unlock()
+		return
+	}
+	cm.trimming = true
+	defer func() {
+		cm.mu.Lock()
+		cm.trimming = false
+		cm.mu.Unlock()
+	}()
+
+	conns := gw.conns.Conns()
+	excess := len(conns) - gw.cfg.ConnLowWater
+
+	// Forget the connections that were closed in the meantime
+	live := make(map[*ps.Conn]bool, len(conns))
+	for _, c := range conns {
+		live[c] = true
+	}
+	for c := range cm.opened {
+		if !live[c] {
+			delete(cm.opened, c)
+		}
+	}
+
+	type candidate struct {
+		conn    *ps.Conn
+		opened  time.Time
+		streams int
+	}
+	var cands []candidate
+	now := time.Now()
+	for _, c := range conns {
+		opened, ok := cm.opened[c]
+		if !ok || now.Sub(opened) < ConnGracePeriod {
+			continue
+		}
+		if mc, ok := c.Conn().(*muxConn); ok && len(cm.protected[mc.remoteID]) > 0 {
+			continue
+		}
+		cands = append(cands, candidate{c, opened, len(c.Streams())})
+	}
+	cm.mu.Unlock()
+
+	if excess <= 0 {
+		return
+	}
+
+	sort.Slice(cands, func(i, j int) bool {
+		a, b := cands[i], cands[j]
+		if (a.streams == 0) != (b.streams == 0) {
+			return a.streams == 0
+		}
+		return a.opened.Before(b.opened)
+	})
+
+	for i := 0; i < excess && i < len(cands); i++ {
+		cands[i].conn.Close()
+	}
+}
@@ -0,0 +1,237 @@
+package gway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/Gaboose/go-pubsub/pnet/peerstore"
+	"github.com/ipfs/go-ipfs/thirdparty/multierr"
+	ma "github.com/jbenet/go-multiaddr"
+	manet "github.com/jbenet/go-multiaddr-net"
+)
+
+// DialStagger is the delay between starting dials to consecutive addresses
+// of the same peer. Addresses further down the list get a chance to connect
+// only if the earlier ones are slow or unreachable.
+var DialStagger = 250 * time.Millisecond
+
+// MaxDialAddrs is how many addresses of a peer are tried at most, in the
+// order of sortAddrs. MaxConcurrentDials bounds the dials that a gateway
+// runs at a time, over all peers. It's read when the gateway is created.
+// Circuit addresses don't count, since dialing their relay does.
+var (
+	MaxDialAddrs       = 16
+	MaxConcurrentDials = 32
+)
+
+type dialResult struct {
+	addr []byte
+	conn *authConn
+	err  error
+}
+
+// dialAddrs dials the first MaxDialAddrs addresses of p in parallel,
+// starting them DialStagger apart. The first connection to succeed and authenticate as p is returned
+// and the remaining dials are canceled, as are all of them when ctx is done.
+// The address that worked is remembered and tried first next time, and kept
+// in the peerstore.
+func (gw *Gateway) dialAddrs(ctx context.Context, p *PeerInfo) (*authConn, error) {
+	addrs := gw.sortAddrs(p)
+	if len(addrs) == 0 {
+		return nil, errors.New("peer has no addresses")
+	}
+	if len(addrs) > MaxDialAddrs {
+		addrs = addrs[:MaxDialAddrs]
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	for i, bts := range addrs {
+		go gw.dialAddr(ctx, bts, p.ID, time.Duration(i)*DialStagger, results)
+	}
+
+	retErr := multierr.New()
+	retErr.Errors = make([]error, 0, len(addrs))
+	for i := range addrs {
+		r := <-results
+		if r.err == nil {
+			gw.goodAddrsmu.Lock()
+			gw.goodAddrs[p.Id()] = r.addr
+			gw.goodAddrsmu.Unlock()
+			gw.peers.AddAddrs(r.conn.remoteID, [][]byte{r.addr}, peerstore.ConnectedAddrTTL)
+
+			// Close the losers as they come in.
+			go closeResults(results, len(addrs)-i-1)
+			return r.conn, nil
+		}
+		retErr.Errors = append(retErr.Errors, r.err)
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, retErr
+}
+
+// sortAddrs returns p's addresses with the last known good one first.
+// Relayed addresses go last, so that they're only a fallback.
+func (gw *Gateway) sortAddrs(p *PeerInfo) [][]byte {
+	gw.goodAddrsmu.Lock()
+	good, ok := gw.goodAddrs[p.Id()]
+	gw.goodAddrsmu.Unlock()
+
+	addrs := make([][]byte, 0, len(p.MAddrs))
+	var relayed [][]byte
+	for _, bts := range p.MAddrs {
+		if ok && string(bts) == string(good) {
+			addrs = append([][]byte{bts}, addrs...)
+		} else if IsCircuit(bts) {
+			relayed = append(relayed, bts)
+		} else {
+			addrs = append(addrs, bts)
+		}
+	}
+	return append(addrs, relayed...)
+}
+
+func (gw *Gateway) dialAddr(ctx context.Context, bts []byte, expect string, delay time.Duration, out chan<- dialResult) {
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		out <- dialResult{bts, nil, ctx.Err()}
+		return
+	}
+
+	if !IsCircuit(bts) {
+		select {
+		case gw.dialSlots <- true:
+			defer func() { <-gw.dialSlots }()
+		case <-ctx.Done():
+			out <- dialResult{bts, nil, ctx.Err()}
+			return
+		}
+	}
+
+	m, err := parseAddr(bts)
+	if err != nil {
+		out <- dialResult{bts, nil, err}
+		return
+	}
+
+	nc, err := gw.dialNet(ctx, m, expect)
+	if err != nil {
+		out <- dialResult{bts, nil, err}
+		return
+	}
+
+	ac, err := gw.upgrade(ctx, nc, expect, false)
+	if err != nil {
+		nc.Close()
+		out <- dialResult{bts, nil, err}
+		return
+	}
+	out <- dialResult{bts, ac, nil}
+}
+
+// dialNet opens a connection to m, which is yet to be upgraded. Circuit
+// addresses are dialed through their relay, which is asked to connect us
+// with the peer expect, and memory addresses within the process. Addresses
+// the gater refuses aren't dialed at all.
+func (gw *Gateway) dialNet(ctx context.Context, m ma.Multiaddr, expect string) (net.Conn, error) {
+	if gw.cfg.Gater != nil && !gw.cfg.Gater.InterceptDial(expect, m) {
+		return nil, ErrGated
+	}
+
+	if raddr, rid, ok := splitCircuit(m); ok {
+		return gw.dialRelay(ctx, raddr, rid, expect)
+	}
+	if name, ok := memoryName(m); ok {
+		return dialMemory(ctx, name)
+	}
+
+	m, isWS := splitWS(m)
+	mc, err := dialConn(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	if !isWS {
+		return mc, nil
+	}
+
+	wc, err := wsClient(ctx, mc, mc.RemoteAddr().String())
+	if err != nil {
+		mc.Close()
+		return nil, err
+	}
+	return wc, nil
+}
+
+// dialConn dials m with manet, which knows tcp as well as utp. Not every
+// transport honours Dialer.Cancel, so a dial that outlives ctx is closed in
+// the background.
+func dialConn(ctx context.Context, m ma.Multiaddr) (manet.Conn, error) {
+	d := &manet.Dialer{}
+	d.Dialer.Cancel = ctx.Done()
+	if deadline, ok := ctx.Deadline(); ok {
+		d.Dialer.Timeout = deadline.Sub(time.Now())
+	}
+
+	type result struct {
+		conn manet.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := d.Dial(m)
+		done <- result{c, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// pruneGoodAddrs forgets the good addresses that the peerstore doesn't
+// have anymore, because they expired or their peer was forgotten.
+func (gw *Gateway) pruneGoodAddrs() {
+	gw.goodAddrsmu.Lock()
+	defer gw.goodAddrsmu.Unlock()
+
+	for id, good := range gw.goodAddrs {
+		s, _ := id.(string)
+		if !containsAddr(gw.peers.Addrs(s), good) {
+			delete(gw.goodAddrs, id)
+		}
+	}
+}
+
+func containsAddr(addrs [][]byte, a []byte) bool {
+	for _, b := range addrs {
+		if bytes.Equal(a, b) {
+			return true
+		}
+	}
+	return false
+}
+
+func closeResults(results <-chan dialResult, n int) {
+	for i := 0; i < n; i++ {
+		r := <-results
+		if r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
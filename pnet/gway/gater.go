@@ -0,0 +1,270 @@
+package gway
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	ma "github.com/jbenet/go-multiaddr"
+	manet "github.com/jbenet/go-multiaddr-net"
+)
+
+// ErrGated is returned for connections that the gater refused.
+var ErrGated = errors.New("connection refused by gater")
+
+// ConnGater decides which connections a gateway may have. Relayed
+// connections come with a circuit address, e.g. /ipfs/<relay ID>/p2p-circuit.
+type ConnGater interface {
+	// InterceptDial is asked before dialing addr. id is the peer expected
+	// at the other end, or empty if any peer will do.
+	InterceptDial(id string, addr ma.Multiaddr) bool
+
+	// InterceptAccept is asked about an inbound connection from addr
+	// before the handshake.
+	InterceptAccept(addr ma.Multiaddr) bool
+
+	// InterceptSecured is asked once the handshake has proven that the
+	// peer id is at the other end.
+	InterceptSecured(inbound bool, id string, addr ma.Multiaddr) bool
+}
+
+// remoteMultiaddr returns the address at the other end of nc, or nil if it
+// can't be told.
+func remoteMultiaddr(nc net.Conn) ma.Multiaddr {
+	addr := nc.RemoteAddr()
+	switch a := addr.(type) {
+	case circuitAddr:
+		m, err := ma.NewMultiaddr(a.String())
+		if err != nil {
+			return nil
+		}
+		return m
+	case memoryAddr:
+		return memoryMultiaddr(a)
+	}
+
+	m, err := manet.FromNetAddr(addr)
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+// CloseGated closes the connections that the gater doesn't allow anymore,
+// e.g. after its rules have changed.
+func (gw *Gateway) CloseGated() {
+	if gw.cfg.Gater == nil {
+		return
+	}
+	for _, c := range gw.conns.Conns() {
+		mc, ok := c.Conn().(*muxConn)
+		if !ok {
+			continue
+		}
+		addr := remoteMultiaddr(c.NetConn())
+		if !gw.cfg.Gater.InterceptSecured(mc.inbound, mc.remoteID, addr) {
+			c.Close()
+		}
+	}
+}
+
+// Rule of a ListGater. It applies either to a peer ID or to the addresses in
+// an IP network.
+type Rule struct {
+	Allow bool
+	Peer  string
+	Net   *net.IPNet
+}
+
+// ParseRule reads a rule like "deny peer <ID>" or "allow net 10.0.0.0/8".
+func ParseRule(s string) (Rule, error) {
+	f := strings.Fields(s)
+	if len(f) != 3 {
+		return Rule{}, fmt.Errorf("rule %q isn't <allow|deny> <peer|net> <value>", s)
+	}
+
+	var r Rule
+	switch f[0] {
+	case "allow":
+		r.Allow = true
+	case "deny":
+	default:
+		return Rule{}, fmt.Errorf("rule %q doesn't start with allow or deny", s)
+	}
+
+	switch f[1] {
+	case "peer":
+		r.Peer = f[2]
+	case "net":
+		_, ipnet, err := net.ParseCIDR(f[2])
+		if err != nil {
+			return Rule{}, err
+		}
+		r.Net = ipnet
+	default:
+		return Rule{}, fmt.Errorf("rule %q applies to neither peer nor net", s)
+	}
+	return r, nil
+}
+
+func (r Rule) String() string {
+	action := "deny"
+	if r.Allow {
+		action = "allow"
+	}
+	if r.Net != nil {
+		return action + " net " + r.Net.String()
+	}
+	return action + " peer " + r.Peer
+}
+
+// ReadRules parses a rule per line. Empty lines and those starting with #
+// are skipped.
+func ReadRules(rd io.Reader) ([]Rule, error) {
+	var rules []Rule
+	sc := bufio.NewScanner(rd)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := ParseRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, sc.Err()
+}
+
+// ListGater is a ConnGater with allow and deny lists of peer IDs and IP
+// networks. Deny rules win. If there are any allow rules for peers, only
+// those peers are let through, and likewise for networks. Addresses without
+// an IP that can be told, e.g. relayed ones, are denied as soon as there are
+// allow rules for networks. The rules can be changed at any time.
+type ListGater struct {
+	rules []Rule
+	mu    sync.RWMutex
+}
+
+func NewListGater(rules ...Rule) *ListGater {
+	return &ListGater{rules: rules}
+}
+
+// Add adds r unless it's there already.
+func (g *ListGater) Add(r Rule) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, old := range g.rules {
+		if old.String() == r.String() {
+			return
+		}
+	}
+	g.rules = append(g.rules, r)
+}
+
+// Remove removes r and tells if it was there.
+func (g *ListGater) Remove(r Rule) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for i, old := range g.rules {
+		if old.String() == r.String() {
+			g.rules = append(g.rules[:i], g.rules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Set replaces all rules.
+func (g *ListGater) Set(rules []Rule) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.rules = append([]Rule(nil), rules...)
+}
+
+func (g *ListGater) Rules() []Rule {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return append([]Rule(nil), g.rules...)
+}
+
+func (g *ListGater) InterceptDial(id string, addr ma.Multiaddr) bool {
+	return g.allowAddr(addr) && (id == "" || g.allowPeer(id))
+}
+
+func (g *ListGater) InterceptAccept(addr ma.Multiaddr) bool {
+	return g.allowAddr(addr)
+}
+
+func (g *ListGater) InterceptSecured(inbound bool, id string, addr ma.Multiaddr) bool {
+	return g.allowAddr(addr) && g.allowPeer(id)
+}
+
+func (g *ListGater) allowPeer(id string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	listed, allowed := false, false
+	for _, r := range g.rules {
+		if r.Net != nil {
+			continue
+		}
+		if r.Allow {
+			listed = true
+			allowed = allowed || r.Peer == id
+		} else if r.Peer == id {
+			return false
+		}
+	}
+	return allowed || !listed
+}
+
+func (g *ListGater) allowAddr(addr ma.Multiaddr) bool {
+	ip := addrIP(addr)
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	listed, allowed := false, false
+	for _, r := range g.rules {
+		if r.Net == nil {
+			continue
+		}
+		if r.Allow {
+			listed = true
+			allowed = allowed || ip != nil && r.Net.Contains(ip)
+		} else if ip != nil && r.Net.Contains(ip) {
+			return false
+		}
+	}
+	return allowed || !listed
+}
+
+// addrIP returns the IP that addr starts with, or nil if there's none.
+func addrIP(addr ma.Multiaddr) net.IP {
+	if addr == nil {
+		return nil
+	}
+	ps := addr.Protocols()
+	if len(ps) == 0 {
+		return nil
+	}
+	switch ps[0].Code {
+	case ma.P_IP4, ma.P_IP6:
+	default:
+		return nil
+	}
+
+	s := strings.SplitN(strings.TrimPrefix(addr.String(), "/"), "/", 3)
+	if len(s) < 2 {
+		return nil
+	}
+	return net.ParseIP(s[1])
+}
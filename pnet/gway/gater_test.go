@@ -0,0 +1,65 @@
+package gway
+
+import (
+	"strings"
+	"testing"
+
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+func TestReadRules(t *testing.T) {
+	rules, err := ReadRules(strings.NewReader(`
+# comment
+deny peer Qm1
+allow net 10.0.0.0/8
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].String() != "deny peer Qm1" ||
+		rules[1].String() != "allow net 10.0.0.0/8" {
+		t.Fatalf("unexpected rules %v", rules)
+	}
+
+	_, err = ParseRule("deny host Qm1")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestListGater(t *testing.T) {
+	local := ma.StringCast("/ip4/10.1.2.3/tcp/4002")
+	remote := ma.StringCast("/ip4/1.2.3.4/tcp/4002")
+	relayed := ma.StringCast("/ipfs/QmYyQSo1c1Ym7orWxLYvCrM2EmxFTANf8wXmmE7DWjhx5N/p2p-circuit")
+
+	g := NewListGater()
+	if !g.InterceptSecured(true, "Qm1", remote) {
+		t.Fatal("expected everything to be allowed without rules")
+	}
+	if !g.InterceptAccept(relayed) || !g.InterceptAccept(nil) {
+		t.Fatal("expected addresses without an IP to be allowed without rules")
+	}
+
+	deny, _ := ParseRule("deny peer Qm1")
+	g.Add(deny)
+	if g.InterceptSecured(true, "Qm1", remote) || !g.InterceptSecured(true, "Qm2", remote) {
+		t.Fatal("expected only Qm1 to be denied")
+	}
+	if !g.InterceptDial("", remote) {
+		t.Fatal("expected a dial to any peer to be allowed")
+	}
+
+	allow, _ := ParseRule("allow net 10.0.0.0/8")
+	g.Add(allow)
+	if g.InterceptAccept(remote) || !g.InterceptAccept(local) {
+		t.Fatal("expected only 10.0.0.0/8 to be allowed")
+	}
+	if g.InterceptAccept(relayed) || g.InterceptAccept(nil) {
+		t.Fatal("expected addresses without an IP to be denied")
+	}
+
+	g.Remove(allow)
+	if !g.InterceptAccept(remote) {
+		t.Fatal("expected the rule to be removed")
+	}
+}
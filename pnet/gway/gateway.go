@@ -1,86 +1,270 @@
 package gway
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/Gaboose/go-pubsub/pnet"
+	"github.com/Gaboose/go-pubsub/pnet/peerstore"
+	"github.com/Gaboose/go-pubsub/svice/autonat"
+	"github.com/Gaboose/go-pubsub/svice/identify"
+	"github.com/Gaboose/go-pubsub/svice/relay"
 	"github.com/ipfs/go-ipfs/thirdparty/multierr"
 	ma "github.com/jbenet/go-multiaddr"
 	manet "github.com/jbenet/go-multiaddr-net"
 	ps "github.com/jbenet/go-peerstream"
-	yamux "github.com/jbenet/go-stream-muxer/yamux"
 	ms "github.com/whyrusleeping/go-multistream"
 )
 
-var transport = yamux.DefaultTransport
+// PeerstoreGCInterval is how often the peerstore forgets the peers that
+// have neither addresses left nor a connection.
+var PeerstoreGCInterval = 10 * time.Minute
+
+// Config holds the settings of a Gateway. The zero value is usable.
+type Config struct {
+	// Identity is the keypair the gateway authenticates itself with.
+	// A new one is generated if it's nil.
+	Identity *Identity
+
+	// Insecure disables encryption. Connections are still authenticated,
+	// but only gateways with the same setting can talk to each other.
+	// Meant for tests and debugging.
+	Insecure bool
+
+	// Muxers lists the stream muxers to negotiate in order of preference.
+	// Names missing from the Muxers map are skipped. DefaultMuxers is
+	// used if it's nil.
+	Muxers []string
+
+	// ConnLowWater and ConnHighWater bound the number of connections.
+	// Once there are more than ConnHighWater, the least useful ones are
+	// closed until ConnLowWater are left. There's no limit if
+	// ConnHighWater is 0, otherwise ConnLowWater mustn't be above it.
+	ConnLowWater  int
+	ConnHighWater int
+
+	// Gater decides which connections are let through. All of them are
+	// if it's nil.
+	Gater ConnGater
+}
 
 type Gateway struct {
+	cfg    Config
+	id     *Identity
 	conns  *ps.Swarm
-	router *ms.MultistreamMuxer
+	router *router
+
+	// goodAddrs remembers the address that last connected to each peer
+	goodAddrs   map[interface{}][]byte
+	goodAddrsmu sync.Mutex
+	dialSlots   chan bool // taken by the dials running, see MaxConcurrentDials
+
+	// nat is the outcome of the last reachability check
+	nat   autonat.Result
+	natmu sync.Mutex
+
+	listenAddrs   [][]byte
+	listenAddrsmu sync.Mutex
+
+	peers *peerstore.Peerstore
+	ident *identify.Identify
+	cm    *connManager
+	bw    *bandwidth
+
+	protonets   map[*ProtoNet]bool
+	protonetsmu sync.Mutex
+
+	stopGC        chan bool
+	listenersOnce sync.Once
+	closeOnce     sync.Once
 }
 
+// NewGateway returns a Gateway with a fresh identity and default settings.
 func NewGateway() *Gateway {
-	router := ms.NewMultistreamMuxer()
+	return NewGatewayConfig(Config{})
+}
+
+// NewGatewayConfig returns a Gateway with the settings of cfg. It panics if
+// the connection watermarks are the wrong way around.
+func NewGatewayConfig(cfg Config) *Gateway {
+	if cfg.ConnHighWater > 0 && cfg.ConnLowWater > cfg.ConnHighWater {
+		panic(errors.New("ConnLowWater is above ConnHighWater"))
+	}
 
-	conns := ps.NewSwarm(transport)
-	conns.SetStreamHandler(func(s *ps.Stream) {
+	id := cfg.Identity
+	if id == nil {
+		var err error
+		id, err = GenerateIdentity()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	gw := &Gateway{
+		cfg:       cfg,
+		id:        id,
+		router:    newRouter(),
+		goodAddrs: make(map[interface{}][]byte),
+		dialSlots: make(chan bool, MaxConcurrentDials),
+		peers:     peerstore.New(),
+		cm:        newConnManager(),
+		bw:        newBandwidth(),
+		protonets: make(map[*ProtoNet]bool),
+	}
+	gw.ident = &identify.Identify{Host: gw, Peerstore: gw.peers, Dialable: dialable}
+
+	gw.conns = ps.NewSwarm(transport{gw})
+	gw.conns.SetConnHandler(func(c *ps.Conn) {
+		// Group connections by the authenticated peer ID, so that we
+		// reuse them no matter which side dialed.
+		if mc, ok := c.Conn().(*muxConn); ok {
+			gw.conns.AddConnToGroup(c, mc.remoteID)
+		}
+		gw.connOpened(c)
+		go gw.identifyConn(c)
+	})
+	gw.conns.Notify((*notifiee)(gw))
+	gw.conns.SetStreamHandler(func(s *ps.Stream) {
 		go func() {
-			router.Handle(s)
+			gw.router.Handle(s)
 		}()
 	})
 
-	return &Gateway{
-		conns:  conns,
-		router: router,
-	}
+	// Peers behind relays are reached through here
+	gw.router.AddHandler(relay.StopProto, gw.handleRelayed)
+	gw.router.AddHandler(identify.Proto, gw.handleIdentify)
+
+	gw.stopGC = gw.peerstoreGC(PeerstoreGCInterval)
+	return gw
 }
 
+// notifiee passes on the notifications of the swarm to the gateway.
+type notifiee Gateway
+
+func (n *notifiee) Connected(*ps.Conn)      {}
+func (n *notifiee) Disconnected(c *ps.Conn) { (*Gateway)(n).disconnected(c) }
+func (n *notifiee) OpenedStream(*ps.Stream) {}
+func (n *notifiee) ClosedStream(*ps.Stream) {}
+
+// disconnected stops tracking c, and its peer if it has no other
+// connections.
+func (gw *Gateway) disconnected(c *ps.Conn) {
+	gw.connClosed(c)
+	gw.forgetPeer(c)
+}
+
+// ID returns the peer ID of this gateway.
+func (gw *Gateway) ID() string { return gw.id.ID() }
+
 func (gw *Gateway) Dial(dest pnet.Peer, proto string) (io.ReadWriteCloser, error) {
+	return gw.DialContext(context.Background(), dest, proto)
+}
+
+// DialContext opens a stream to dest and selects proto on it. Connecting
+// and protocol selection are both abandoned as soon as ctx is done. The
+// traffic of the stream is accounted for in Bandwidth.
+func (gw *Gateway) DialContext(ctx context.Context, dest pnet.Peer, proto string) (io.ReadWriteCloser, error) {
+	return gw.dialProtos(ctx, dest, []string{proto})
+}
+
+// dialProtos is like DialContext, but selects the first of protos that dest
+// supports. The stream tells which one it was by its Protocol method.
+func (gw *Gateway) dialProtos(ctx context.Context, dest pnet.Peer, protos []string) (io.ReadWriteCloser, error) {
 	// See if we already have a connection with this peer.
 	s, err := gw.conns.NewStreamWithGroup(dest.Id())
 	if err != nil {
 		// We don't, let's create a new connection.
 
-		//TODO: Dial many/all addrs, use earliest. Like here:
-		//https://github.com/ipfs/go-ipfs/blob/master/p2p/net/swarm/swarm_dial.go
-		p, ok := dest.(*PeerInfo)
-		if !ok {
-			return nil, errors.New("Unknown pnet.Peer type")
-		}
-
-		m, err := ma.NewMultiaddrBytes(p.MAddrs[0])
+		p, err := gw.peerInfo(dest)
 		if err != nil {
 			return nil, err
 		}
 
-		nc, err := manet.Dial(m)
+		c, err := gw.connect(ctx, p)
 		if err != nil {
 			return nil, err
 		}
 
-		c, err := gw.conns.AddConn(nc)
+		s, err = c.NewStream()
 		if err != nil {
-			nc.Close()
 			return nil, err
 		}
-		gw.conns.AddConnToGroup(c, p.Id())
+	}
 
-		s, err = gw.conns.NewStreamWithGroup(p.Id())
-		if err != nil {
-			return nil, err
+	// Select the protocol on the new stream. A stalled remote would block
+	// this forever, so close the stream if ctx is done first.
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-done:
 		}
-	}
+	}()
+	proto, err := ms.SelectOneOf(protos, s)
+	close(done)
 
-	// Select the protocol on the new stream.
-	err = ms.SelectProtoOrFail(proto, s)
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
 	if err != nil {
 		s.Close()
+		return nil, err
+	}
+
+	return gw.meterStream(s, proto), nil
+}
+
+// peerInfo returns the PeerInfo to connect to dest with. Addresses of dest
+// are recorded in the peerstore and the ones already there fill in for them
+// if dest has none, or if it's known by ID only.
+func (gw *Gateway) peerInfo(dest pnet.Peer) (*PeerInfo, error) {
+	p, ok := dest.(*PeerInfo)
+	if !ok {
+		id, ok := dest.Id().(string)
+		if !ok {
+			return nil, errors.New("Unknown pnet.Peer type")
+		}
+		p = &PeerInfo{ID: id}
+	}
+	if p.ID == "" {
+		return p, nil
+	}
+
+	if len(p.MAddrs) > 0 {
+		gw.peers.AddAddrs(p.ID, p.MAddrs, peerstore.TempAddrTTL)
+		return p, nil
+	}
+	return &PeerInfo{ID: p.ID, MAddrs: gw.peers.Addrs(p.ID)}, nil
+}
+
+// Connect makes sure there's a connection with p, without opening any
+// streams. E.g. a peer behind a relay has to stay connected with it.
+func (gw *Gateway) Connect(ctx context.Context, p *PeerInfo) error {
+	if gw.connected(p.ID) {
+		return nil
+	}
+	_, err := gw.connect(ctx, p)
+	return err
+}
+
+func (gw *Gateway) connect(ctx context.Context, p *PeerInfo) (*ps.Conn, error) {
+	nc, err := gw.dialAddrs(ctx, p)
+	if err != nil {
+		return nil, err
 	}
 
-	return s, err
+	c, err := gw.conns.AddConn(nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
 }
 
 func (gw *Gateway) ListenAll(maddrs [][]byte) error {
@@ -94,7 +278,7 @@ func (gw *Gateway) ListenAll(maddrs [][]byte) error {
 
 	// listen on every address
 	for _, bts := range maddrs {
-		m, err := ma.NewMultiaddrBytes(bts)
+		m, err := parseAddr(bts)
 		if err != nil {
 			addErr(err)
 			continue
@@ -112,41 +296,190 @@ func (gw *Gateway) ListenAll(maddrs [][]byte) error {
 	return nil
 }
 
+// CloseListeners stops accepting new connections. The ones already open
+// are left alone.
+func (gw *Gateway) CloseListeners() error {
+	var retErr error
+	gw.listenersOnce.Do(func() {
+		errs := multierr.New()
+		for _, l := range gw.conns.Listeners() {
+			err := l.Close()
+			if err != nil {
+				errs.Errors = append(errs.Errors, err)
+			}
+		}
+		if errs.Errors != nil {
+			retErr = errs
+		}
+	})
+	return retErr
+}
+
+// Close is Shutdown without a time limit.
 func (gw *Gateway) Close() error {
-	return gw.conns.Close()
+	return gw.Shutdown(context.Background())
 }
 
+// Shutdown stops accepting connections, closes every ProtoNet, so that
+// their listeners return ErrProtoNetClosed, and then closes the connections.
+// If ctx is done before the connections are, they're left to close in the
+// background and ctx.Err() is returned. Only the first call does anything.
+func (gw *Gateway) Shutdown(ctx context.Context) error {
+	first := false
+	gw.closeOnce.Do(func() { first = true })
+	if !first {
+		return nil
+	}
+
+	close(gw.stopGC)
+
+	retErr := multierr.New()
+	err := gw.CloseListeners()
+	if err != nil {
+		retErr.Errors = append(retErr.Errors, err)
+	}
+
+	gw.protonetsmu.Lock()
+	pns := make([]*ProtoNet, 0, len(gw.protonets))
+	for pn := range gw.protonets {
+		pns = append(pns, pn)
+	}
+	gw.protonetsmu.Unlock()
+	for _, pn := range pns {
+		pn.Close()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- gw.conns.Close() }()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		retErr.Errors = append(retErr.Errors, err)
+	}
+
+	if retErr.Errors != nil {
+		return retErr
+	}
+	return nil
+}
+
+// NewProtoNet returns a ProtoNet of proto. Streams of it are accepted once
+// it Listens.
 func (gw *Gateway) NewProtoNet(proto string) *ProtoNet {
-	acceptCh := make(chan io.ReadWriteCloser)
-	closeCh := make(chan bool)
+	return gw.NewProtoNetMatch(proto, nil)
+}
 
-	gw.router.AddHandler(proto, func(rwc io.ReadWriteCloser) error {
-		select {
-		case acceptCh <- rwc:
-			return nil
-		case <-closeCh:
-			gw.router.RemoveHandler(proto)
-			return errors.New("ProtoNet is closed")
-		}
-	})
+// NewProtoNetMatch is like NewProtoNet, but the ProtoNet also accepts the
+// protocols that match takes, e.g. SemverMatch(proto) for older versions of
+// proto. When dialing, proto is proposed first and then the fallbacks in
+// order, so that peers that don't know proto yet can still be reached.
+func (gw *Gateway) NewProtoNetMatch(proto string, match MatchFunc, fallbacks ...string) *ProtoNet {
+	pn := &ProtoNet{
+		proto:     proto,
+		match:     match,
+		fallbacks: fallbacks,
+		closeCh:   make(chan bool),
+		gw:        gw,
+	}
+	gw.protonetsmu.Lock()
+	gw.protonets[pn] = true
+	gw.protonetsmu.Unlock()
+	return pn
+}
+
+// NewProtoDialer returns a dialer of proto. Unlike NewProtoNet, it leaves
+// incoming streams of proto alone.
+func (gw *Gateway) NewProtoDialer(proto string) *ProtoDialer {
+	return &ProtoDialer{proto, gw}
+}
 
-	return &ProtoNet{proto, acceptCh, closeCh, gw}
+// NewRelay returns a relay service on top of this gateway. Serve it to
+// forward streams for other peers.
+func (gw *Gateway) NewRelay() *relay.Relay {
+	return &relay.Relay{
+		ProtoNet:  gw.NewProtoNet(relay.HopProto),
+		StopNet:   gw.NewProtoDialer(relay.StopProto),
+		Connected: gw.connected,
+	}
+}
+
+// connected tells whether there's a connection with the peer id.
+func (gw *Gateway) connected(id string) bool {
+	return len(gw.conns.ConnsWithGroup(id)) > 0
 }
 
 func (gw *Gateway) listen(addr ma.Multiaddr) error {
-	lnet, lnaddr, err := manet.DialArgs(addr)
-	if err != nil {
-		return err
+	// Relayed connections come in through the relay
+	if _, _, ok := splitCircuit(addr); ok {
+		gw.addListenAddr(addr)
+		return nil
+	}
+
+	var l net.Listener
+	if name, ok := memoryName(addr); ok {
+		ml, err := listenMemory(name)
+		if err != nil {
+			return err
+		}
+		l = ml
+	} else {
+		taddr, isWS := splitWS(addr)
+		ml, err := manet.Listen(taddr)
+		if err != nil {
+			return err
+		}
+
+		// Port 0 is replaced by the one the listener got
+		addr = ml.Multiaddr()
+		l = ml.NetListener()
+		if isWS {
+			addr = addr.Encapsulate(wsMAddr)
+			l = wsListen(l)
+		}
 	}
 
-	l, err := net.Listen(lnet, lnaddr)
+	pl, err := gw.conns.AddListener(l)
 	if err != nil {
 		return err
 	}
 
-	_, err = gw.conns.AddListener(l)
-	if err == nil {
-		fmt.Printf("Swarm listening on %v\n", addr)
-	}
-	return err
+	// Failed handshakes are reported here. Nobody needs them, but the
+	// listener stalls if they're not consumed.
+	go func() {
+		for range pl.AcceptErrors() {
+		}
+	}()
+
+	gw.addListenAddr(addr)
+	fmt.Printf("Swarm listening on %v\n", addr)
+	return nil
+}
+
+func (gw *Gateway) addListenAddr(addr ma.Multiaddr) {
+	gw.listenAddrsmu.Lock()
+	gw.listenAddrs = append(gw.listenAddrs, addr.Bytes())
+	gw.listenAddrsmu.Unlock()
+}
+
+// peerstoreGC forgets the unconnected peers without addresses every
+// interval, and the good addresses that went with them or expired.
+func (gw *Gateway) peerstoreGC(interval time.Duration) chan bool {
+	stop := make(chan bool)
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				gw.peers.GC(gw.connected)
+				gw.pruneGoodAddrs()
+			case <-stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return stop
 }
@@ -0,0 +1,998 @@
+package gway
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/go-pubsub/pnet/peerstore"
+	"github.com/Gaboose/go-pubsub/svice/autonat"
+	"github.com/Gaboose/go-pubsub/svice/identify"
+	ma "github.com/jbenet/go-multiaddr"
+	manet "github.com/jbenet/go-multiaddr-net"
+)
+
+func TestDialManyAddrs(t *testing.T) {
+	good := MemoryAddr("dialmanyaddrs")
+	bad, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gw1 := NewGateway()
+	defer gw1.Close()
+	err = gw1.ListenAll([][]byte{good})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pn1 := gw1.NewProtoNet("/foo")
+	defer pn1.Close()
+	ln := pn1.Listen()
+	defer ln.Close()
+	go func() {
+		s, err := ln.Accept()
+		if err == nil {
+			s.Close()
+		}
+	}()
+
+	gw2 := NewGateway()
+	defer gw2.Close()
+	pn2 := gw2.NewProtoNet("/foo")
+	defer pn2.Close()
+
+	dest := &PeerInfo{
+		ID:     gw1.ID(),
+		MAddrs: [][]byte{bad.Bytes(), good},
+	}
+
+	s, err := pn2.Dial(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	addrs := gw2.sortAddrs(dest)
+	if !bytes.Equal(addrs[0], good) {
+		t.Fatalf("expected /memory/dialmanyaddrs to be tried first, got %q", addrs[0])
+	}
+}
+
+func TestMaxDialAddrs(t *testing.T) {
+	defer func(n int) { MaxDialAddrs = n }(MaxDialAddrs)
+	MaxDialAddrs = 1
+
+	good := MemoryAddr("maxdialaddrs")
+	bad, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gw1 := NewGateway()
+	defer gw1.Close()
+	err = gw1.ListenAll([][]byte{good})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gw2 := NewGateway()
+	defer gw2.Close()
+
+	// Only the first address is tried
+	err = gw2.Connect(context.Background(), &PeerInfo{
+		ID:     gw1.ID(),
+		MAddrs: [][]byte{bad.Bytes(), good},
+	})
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+}
+
+func TestDialAllFail(t *testing.T) {
+	bad1, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad2, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gw := NewGateway()
+	defer gw.Close()
+	pn := gw.NewProtoNet("/foo")
+	defer pn.Close()
+
+	dest := &PeerInfo{
+		ID:     "bob",
+		MAddrs: [][]byte{bad1.Bytes(), bad2.Bytes()},
+	}
+
+	_, err = pn.Dial(dest)
+	if err == nil {
+		t.Fatal("expected error from ProtoNet.Dial, got nil")
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	m := MemoryAddr("impersonation")
+
+	gw1 := NewGateway()
+	defer gw1.Close()
+	err := gw1.ListenAll([][]byte{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pn1 := gw1.NewProtoNet("/foo")
+	defer pn1.Close()
+
+	gw2 := NewGateway()
+	defer gw2.Close()
+	pn2 := gw2.NewProtoNet("/foo")
+	defer pn2.Close()
+
+	// Someone else's ID at gw1's address
+	other, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := &PeerInfo{
+		ID:     other.ID(),
+		MAddrs: [][]byte{m},
+	}
+
+	_, err = pn2.Dial(dest)
+	if err == nil {
+		t.Fatal("expected error from ProtoNet.Dial, got nil")
+	}
+}
+
+func TestLoadIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "identity")
+
+	id1, err := LoadIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := LoadIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id1.ID() != id2.ID() {
+		t.Fatalf("expected %s after reload, got %s", id1.ID(), id2.ID())
+	}
+}
+
+func TestInsecure(t *testing.T) {
+	m := MemoryAddr("insecure")
+
+	gw1 := NewGatewayConfig(Config{Insecure: true})
+	defer gw1.Close()
+	err := gw1.ListenAll([][]byte{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pn1 := gw1.NewProtoNet("/foo")
+	defer pn1.Close()
+	ln := pn1.Listen()
+	defer ln.Close()
+	go func() {
+		for {
+			s, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.Close()
+		}
+	}()
+
+	dest := &PeerInfo{
+		ID:     gw1.ID(),
+		MAddrs: [][]byte{m},
+	}
+
+	gw2 := NewGatewayConfig(Config{Insecure: true})
+	defer gw2.Close()
+	pn2 := gw2.NewProtoNet("/foo")
+	defer pn2.Close()
+
+	s, err := pn2.Dial(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Encrypting gateways refuse to talk in plaintext
+	gw3 := NewGateway()
+	defer gw3.Close()
+	pn3 := gw3.NewProtoNet("/foo")
+	defer pn3.Close()
+
+	_, err = pn3.Dial(dest)
+	if err == nil {
+		t.Fatal("expected error from ProtoNet.Dial, got nil")
+	}
+}
+
+func TestMuxers(t *testing.T) {
+	// Over TCP, because the vendored multiplex can panic when a stream is
+	// closed while data for it arrives, which the synchronous pipes of
+	// memory connections make likely
+	m, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gw1 := NewGateway()
+	defer gw1.Close()
+	err = gw1.ListenAll([][]byte{m.Bytes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = ma.Cast(gw1.ListenAddrs()[0])
+	pn1 := gw1.NewProtoNet("/echo")
+	defer pn1.Close()
+	ln := pn1.Listen()
+	defer ln.Close()
+	go func() {
+		for {
+			s, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(s, s)
+				s.Close()
+			}()
+		}
+	}()
+
+	dest := &PeerInfo{
+		ID:     gw1.ID(),
+		MAddrs: [][]byte{m.Bytes()},
+	}
+
+	for _, muxer := range DefaultMuxers {
+		gw2 := NewGatewayConfig(Config{Muxers: []string{muxer}})
+		pn2 := gw2.NewProtoNet("/echo")
+
+		s, err := pn2.Dial(dest)
+		if err != nil {
+			t.Fatalf("%s: %v", muxer, err)
+		}
+
+		err = echo(s)
+		if err != nil {
+			t.Fatalf("%s: %v", muxer, err)
+		}
+
+		got := gw2.conns.Conns()[0].Conn().(*muxConn).muxer
+		if got != muxer {
+			t.Fatalf("expected %s to be negotiated, got %s", muxer, got)
+		}
+
+		s.Close()
+		pn2.Close()
+		gw2.Close()
+	}
+
+	// No muxer in common
+	gw3 := NewGatewayConfig(Config{Muxers: []string{"/nosuchmuxer"}})
+	defer gw3.Close()
+	pn3 := gw3.NewProtoNet("/echo")
+	defer pn3.Close()
+
+	_, err = pn3.Dial(dest)
+	if err == nil {
+		t.Fatal("expected error from ProtoNet.Dial, got nil")
+	}
+}
+
+func TestWebsocket(t *testing.T) {
+	defer func(h, r time.Duration) { WSReadHeaderTimeout, WSReadTimeout = h, r }(WSReadHeaderTimeout, WSReadTimeout)
+	WSReadHeaderTimeout = 50 * time.Millisecond
+	WSReadTimeout = 50 * time.Millisecond
+
+	m, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gw1 := NewGateway()
+	defer gw1.Close()
+	err = gw1.ListenAll([][]byte{m.Bytes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = ma.Cast(gw1.ListenAddrs()[0])
+	pn1 := gw1.NewProtoNet("/echo")
+	defer pn1.Close()
+	ln := pn1.Listen()
+	defer ln.Close()
+	go func() {
+		s, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(s, s)
+		s.Close()
+	}()
+
+	gw2 := NewGateway()
+	defer gw2.Close()
+	pn2 := gw2.NewProtoNet("/echo")
+	defer pn2.Close()
+
+	dest := &PeerInfo{
+		ID:     gw1.ID(),
+		MAddrs: [][]byte{m.Bytes()},
+	}
+
+	s, err := pn2.Dial(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	err = echo(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection outlives the timeouts of the request that opened it
+	time.Sleep(100 * time.Millisecond)
+	err = echo(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// while a client that never sends a request is hung up on
+	nm, _ := splitWS(m)
+	c, err := manet.Dial(nm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = c.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("expected the server to hang up, got %v", err)
+	}
+}
+
+func TestUTP(t *testing.T) {
+	m, err := ma.NewMultiaddr("/ip4/127.0.0.1/udp/0/utp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gw1 := NewGateway()
+	defer gw1.Close()
+	err = gw1.ListenAll([][]byte{m.Bytes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = ma.Cast(gw1.ListenAddrs()[0])
+	pn1 := gw1.NewProtoNet("/echo")
+	defer pn1.Close()
+	ln := pn1.Listen()
+	defer ln.Close()
+	go func() {
+		s, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(s, s)
+		s.Close()
+	}()
+
+	gw2 := NewGateway()
+	defer gw2.Close()
+	pn2 := gw2.NewProtoNet("/echo")
+	defer pn2.Close()
+
+	dest := &PeerInfo{
+		ID:     gw1.ID(),
+		MAddrs: [][]byte{m.Bytes()},
+	}
+
+	s, err := pn2.Dial(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	err = echo(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelayed(t *testing.T) {
+	m := MemoryAddr("relayed")
+	bad, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// public relay
+	gwR := NewGateway()
+	defer gwR.Close()
+	err = gwR.ListenAll([][]byte{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gwR.NewRelay()
+	r.Serve()
+	defer r.Stop()
+	relayInfo := &PeerInfo{
+		ID:     gwR.ID(),
+		MAddrs: [][]byte{m},
+	}
+
+	// unreachable peer, connected to the relay
+	gw1 := NewGateway()
+	defer gw1.Close()
+	err = gw1.Connect(context.Background(), relayInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pn1 := gw1.NewProtoNet("/echo")
+	defer pn1.Close()
+	ln := pn1.Listen()
+	defer ln.Close()
+	go func() {
+		s, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(s, s)
+		s.Close()
+	}()
+
+	gw2 := NewGateway()
+	defer gw2.Close()
+	pn2 := gw2.NewProtoNet("/echo")
+	defer pn2.Close()
+
+	dest := &PeerInfo{
+		ID:     gw1.ID(),
+		MAddrs: append(CircuitAddr(relayInfo), bad.Bytes()),
+	}
+
+	s, err := pn2.Dial(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	err = echo(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReachability(t *testing.T) {
+	good := MemoryAddr("reachability")
+	bad := MemoryAddr("reachability-nobody")
+	m := MemoryAddr("reachability-server")
+
+	gwS := NewGateway()
+	defer gwS.Close()
+	err := gwS.ListenAll([][]byte{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := gwS.NewAutoNAT()
+	a.Serve()
+	defer a.Stop()
+
+	gw := NewGateway()
+	defer gw.Close()
+	err = gw.ListenAll([][]byte{good})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	servers := []*PeerInfo{{ID: gwS.ID(), MAddrs: [][]byte{m}}}
+	err = gw.CheckReachability(context.Background(), servers, [][]byte{bad, good})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gw.Reachability() != autonat.Public {
+		t.Fatalf("expected %v, got %v", autonat.Public, gw.Reachability())
+	}
+	confirmed := gw.ConfirmedAddrs()
+	if len(confirmed) != 1 || !bytes.Equal(confirmed[0], good) {
+		t.Fatalf("expected only %v to be confirmed, got %d addresses", good, len(confirmed))
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	m := MemoryAddr("identify")
+
+	gw1 := NewGateway()
+	defer gw1.Close()
+	err := gw1.ListenAll([][]byte{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pn1 := gw1.NewProtoNet("/foo")
+	defer pn1.Close()
+	ln := pn1.Listen()
+	defer ln.Close()
+	go func() {
+		s, err := ln.Accept()
+		if err == nil {
+			s.Close()
+		}
+	}()
+
+	gw2 := NewGateway()
+	defer gw2.Close()
+	pn2 := gw2.NewProtoNet("/foo")
+	defer pn2.Close()
+
+	s, err := pn2.Dial(&PeerInfo{ID: gw1.ID(), MAddrs: [][]byte{m}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Identify runs in the background
+	deadline := time.Now().Add(time.Second)
+	for gw2.Peerstore().Get(gw1.ID(), identify.AgentKey) == nil ||
+		len(gw2.ObservedAddrs()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("identify didn't complete")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	addrs := gw2.Peerstore().Addrs(gw1.ID())
+	if len(addrs) != 1 || !bytes.Equal(addrs[0], m) {
+		t.Fatalf("expected %v to be learned", m)
+	}
+
+	found := false
+	for _, p := range gw2.Peerstore().Protocols(gw1.ID()) {
+		found = found || p == "/foo"
+	}
+	if !found {
+		t.Fatalf("expected /foo in %v", gw2.Peerstore().Protocols(gw1.ID()))
+	}
+
+	if gw2.Peerstore().Latency(gw1.ID()) == 0 {
+		t.Fatal("expected latency to be measured")
+	}
+}
+
+func TestDialFromPeerstore(t *testing.T) {
+	m := MemoryAddr("dialfrompeerstore")
+
+	gw1 := NewGateway()
+	defer gw1.Close()
+	pn1 := gw1.NewProtoNet("/foo")
+	defer pn1.Close()
+	err := gw1.ListenAll([][]byte{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := pn1.Listen()
+	go func() {
+		s, err := ln.Accept()
+		if err == nil {
+			io.Copy(s, s)
+		}
+	}()
+
+	gw2 := NewGateway()
+	defer gw2.Close()
+	pn2 := gw2.NewProtoNet("/foo")
+	defer pn2.Close()
+
+	// Without any addresses there's nothing to dial
+	_, err = pn2.Dial(&PeerInfo{ID: gw1.ID()})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	pn2.Peerstore().AddAddrs(gw1.ID(), [][]byte{m}, peerstore.TempAddrTTL)
+	s, err := pn2.Dial(&PeerInfo{ID: gw1.ID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	err = echo(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrimConns(t *testing.T) {
+	defer func(d time.Duration) { ConnGracePeriod = d }(ConnGracePeriod)
+	ConnGracePeriod = 0
+
+	m := MemoryAddr("trimconns")
+	gw := NewGatewayConfig(Config{ConnLowWater: 1, ConnHighWater: 2})
+	defer gw.Close()
+	err := gw.ListenAll([][]byte{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peers := make([]*Gateway, 3)
+	for i := range peers {
+		peers[i] = NewGateway()
+		defer peers[i].Close()
+	}
+	gw.Protect(peers[1].ID(), "test")
+
+	for _, p := range peers {
+		err := p.Connect(context.Background(), &PeerInfo{ID: gw.ID(), MAddrs: [][]byte{m}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Trimming runs in the background
+	deadline := time.Now().Add(time.Second)
+	for len(gw.conns.Conns()) > 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 1 connection, got %d", len(gw.conns.Conns()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(gw.conns.ConnsWithGroup(peers[1].ID())) != 1 {
+		t.Fatal("expected the protected connection to be kept")
+	}
+
+	// Closed connections aren't tracked anymore
+	gw.conns.ConnsWithGroup(peers[1].ID())[0].Close()
+	deadline = time.Now().Add(time.Second)
+	for {
+		gw.cm.mu.Lock()
+		n := len(gw.cm.opened)
+		gw.cm.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no tracked connections, got %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatermarks(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic")
+		}
+	}()
+	NewGatewayConfig(Config{ConnLowWater: 2, ConnHighWater: 1})
+}
+
+func TestGater(t *testing.T) {
+	m, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+
+	g1 := NewListGater()
+	gw1 := NewGatewayConfig(Config{Gater: g1})
+	defer gw1.Close()
+	pn1 := gw1.NewProtoNet("/foo")
+	defer pn1.Close()
+	err := gw1.ListenAll([][]byte{m.Bytes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = ma.Cast(gw1.ListenAddrs()[0])
+	ln := pn1.Listen()
+	go func() {
+		for {
+			s, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(s, s)
+		}
+	}()
+
+	g2 := NewListGater()
+	gw2 := NewGatewayConfig(Config{Gater: g2})
+	defer gw2.Close()
+	pn2 := gw2.NewProtoNet("/foo")
+	defer pn2.Close()
+	p1 := &PeerInfo{ID: gw1.ID(), MAddrs: [][]byte{m.Bytes()}}
+
+	// Refused when dialing
+	r, _ := ParseRule("deny peer " + gw1.ID())
+	g2.Add(r)
+	_, err = pn2.Dial(p1)
+	if err == nil {
+		t.Fatal("expected the dial to be refused")
+	}
+	g2.Remove(r)
+
+	// Refused when accepting
+	r, _ = ParseRule("deny net 127.0.0.0/8")
+	g1.Add(r)
+	_, err = pn2.Dial(p1)
+	if err == nil {
+		t.Fatal("expected the connection to be refused")
+	}
+	g1.Remove(r)
+
+	s, err := pn2.Dial(p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = echo(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Refused after the rules change
+	r, _ = ParseRule("deny peer " + gw2.ID())
+	g1.Add(r)
+	gw1.CloseGated()
+	if len(gw1.conns.Conns()) != 0 {
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	m := MemoryAddr("bandwidth")
+
+	gw1 := NewGateway()
+	defer gw1.Close()
+	pn1 := gw1.NewProtoNet("/foo")
+	defer pn1.Close()
+	err := gw1.ListenAll([][]byte{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := pn1.Listen()
+	go func() {
+		s, err := ln.Accept()
+		if err == nil {
+			io.Copy(s, s)
+		}
+	}()
+
+	gw2 := NewGateway()
+	defer gw2.Close()
+	pn2 := gw2.NewProtoNet("/foo")
+	defer pn2.Close()
+
+	s, err := pn2.Dial(&PeerInfo{ID: gw1.ID(), MAddrs: [][]byte{m}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = echo(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := BandwidthStats{TotalIn: 5, TotalOut: 5}
+	if st := gw2.BandwidthForProtocol("/foo"); st != expect {
+		t.Fatalf("expected %+v for /foo, got %+v", expect, st)
+	}
+	if st := gw2.BandwidthForPeer(gw1.ID()); st != expect {
+		t.Fatalf("expected %+v for the peer, got %+v", expect, st)
+	}
+	if r := gw2.Bandwidth(); r.Total != expect || len(r.Protocols) != 1 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+
+	// The other end counts the same bytes the other way
+	deadline := time.Now().Add(time.Second)
+	for gw1.BandwidthForPeer(gw2.ID()) != expect {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %+v, got %+v", expect, gw1.BandwidthForPeer(gw2.ID()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The meters of a peer go with its last connection
+	for _, c := range gw2.conns.ConnsWithGroup(gw1.ID()) {
+		c.Close()
+	}
+	deadline = time.Now().Add(time.Second)
+	for len(gw2.Bandwidth().Peers) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no peers, got %+v", gw2.Bandwidth().Peers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := gw2.BandwidthForProtocol("/foo"); st != expect {
+		t.Fatalf("expected %+v for /foo to stay, got %+v", expect, st)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	gw := NewGateway()
+	pn := gw.NewProtoNet("/foo")
+	ln := pn.Listen()
+
+	accepted := make(chan error)
+	go func() {
+		_, err := ln.Accept()
+		accepted <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := gw.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-accepted:
+		if err != ErrProtoNetClosed {
+			t.Fatalf("expected ErrProtoNetClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the listener to be closed")
+	}
+
+	for _, p := range gw.Protocols() {
+		if p == "/foo" {
+			t.Fatal("expected /foo to be handled no more")
+		}
+	}
+
+	// Closing again does nothing
+	err = gw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	addr := MemoryAddr("gw1")
+
+	gw1 := NewGateway()
+	defer gw1.Close()
+	pn1 := gw1.NewProtoNet("/foo")
+	defer pn1.Close()
+	err := gw1.ListenAll([][]byte{addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := pn1.Listen()
+	go func() {
+		for {
+			s, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(s, s)
+		}
+	}()
+
+	// The name is taken for as long as gw1 listens on it
+	gw2 := NewGateway()
+	defer gw2.Close()
+	err = gw2.ListenAll([][]byte{addr})
+	if err == nil {
+		t.Fatal("expected error listening on a taken memory address")
+	}
+
+	pn2 := gw2.NewProtoNet("/foo")
+	defer pn2.Close()
+	s, err := pn2.Dial(&PeerInfo{ID: gw1.ID(), MAddrs: [][]byte{addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = echo(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := parseAddr(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.String() != "/memory/gw1" {
+		t.Fatalf("expected /memory/gw1, got %s", m)
+	}
+
+	// Once gw1 stops listening, it can't be dialed anymore
+	gw1.CloseListeners()
+	_, err = dialMemory(context.Background(), "gw1")
+	if err == nil {
+		t.Fatal("expected error dialing a closed memory address")
+	}
+	err = gw2.ListenAll([][]byte{addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// echo writes to rw and expects to read the same back.
+func echo(rw io.ReadWriter) error {
+	_, err := rw.Write([]byte("hello"))
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(rw, buf)
+	if err != nil {
+		return err
+	}
+	if string(buf) != "hello" {
+		return fmt.Errorf("expected hello, got %s", buf)
+	}
+	return nil
+}
+
+func TestPeerstoreGC(t *testing.T) {
+	defer func(d time.Duration) { PeerstoreGCInterval = d }(PeerstoreGCInterval)
+	PeerstoreGCInterval = 10 * time.Millisecond
+
+	m := MemoryAddr("peerstoregc")
+	gw := NewGateway()
+	defer gw.Close()
+	err := gw.ListenAll([][]byte{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A connected peer without addresses of its own
+	p := NewGateway()
+	defer p.Close()
+	err = p.Connect(context.Background(), &PeerInfo{ID: gw.ID(), MAddrs: [][]byte{m}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for gw.Peerstore().Latency(p.ID()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the peer to be identified")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A peer whose only address expires is forgotten along with its good
+	// address, the connected one is kept
+	gw.Peerstore().AddAddrs("gone", [][]byte{MemoryAddr("gone")}, time.Millisecond)
+	gw.goodAddrsmu.Lock()
+	gw.goodAddrs["gone"] = MemoryAddr("gone")
+	gw.goodAddrsmu.Unlock()
+	deadline = time.Now().Add(time.Second)
+	for len(gw.Peerstore().Peers()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected only the connected peer, got %v", gw.Peerstore().Peers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ids := gw.Peerstore().Peers(); ids[0] != p.ID() {
+		t.Fatalf("expected %s to be kept, got %v", p.ID(), ids)
+	}
+	deadline = time.Now().Add(time.Second)
+	for {
+		gw.goodAddrsmu.Lock()
+		_, has := gw.goodAddrs["gone"]
+		gw.goodAddrsmu.Unlock()
+		if !has {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the good address of the forgotten peer to be dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
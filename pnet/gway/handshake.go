@@ -0,0 +1,91 @@
+package gway
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+)
+
+const nonceSize = 32
+
+// authConn is a connection whose remote end has proven to hold the private
+// key of remoteID.
+type authConn struct {
+	net.Conn
+	remoteID  string
+	remoteKey ed25519.PublicKey
+	muxer     string // set once a stream muxer is negotiated
+	isServer  bool   // which side of the upgrade we were on
+}
+
+// handshake authenticates both ends of a fresh connection. Each side sends
+// its public key, a random nonce and ext, then signs the nonce it has
+// received together with its own ext. If expect isn't empty, the remote's
+// peer ID must equal it.
+//
+// Both sides must pass an ext of the same length. The remote's ext is
+// returned and is as trustworthy as the remote's peer ID.
+func handshake(nc net.Conn, id *Identity, expect string, ext []byte) (*authConn, []byte, error) {
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Exchange public keys, nonces and extensions
+	hello := concat(id.PublicKey(), nonce, ext)
+	theirHello := make([]byte, len(hello))
+	err = exchange(nc, hello, theirHello)
+	if err != nil {
+		return nil, nil, err
+	}
+	theirKey := ed25519.PublicKey(theirHello[:ed25519.PublicKeySize])
+	theirNonce := theirHello[ed25519.PublicKeySize : ed25519.PublicKeySize+nonceSize]
+	theirExt := theirHello[ed25519.PublicKeySize+nonceSize:]
+
+	theirID, err := IDFromPublicKey(theirKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if expect != "" && theirID != expect {
+		return nil, nil, errors.New("peer ID mismatch: dialed " + expect + ", got " + theirID)
+	}
+
+	// Prove that we hold our keys
+	theirSig := make([]byte, ed25519.SignatureSize)
+	err = exchange(nc, id.Sign(concat(theirNonce, ext)), theirSig)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ed25519.Verify(theirKey, concat(nonce, theirExt), theirSig) {
+		return nil, nil, errors.New("peer " + theirID + " failed to authenticate")
+	}
+
+	return &authConn{Conn: nc, remoteID: theirID, remoteKey: theirKey}, theirExt, nil
+}
+
+// exchange writes out and reads len(in) bytes at the same time, so that
+// both ends of an unbuffered connection can call it without deadlocking.
+func exchange(rw io.ReadWriter, out, in []byte) error {
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := rw.Write(out)
+		writeErr <- err
+	}()
+
+	_, err := io.ReadFull(rw, in)
+	if err != nil {
+		return err
+	}
+	return <-writeErr
+}
+
+func concat(bs ...[]byte) []byte {
+	var out []byte
+	for _, b := range bs {
+		out = append(out, b...)
+	}
+	return out
+}
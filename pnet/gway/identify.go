@@ -0,0 +1,89 @@
+package gway
+
+import (
+	"io"
+	"time"
+
+	"github.com/Gaboose/go-pubsub/pnet/peerstore"
+	"github.com/Gaboose/go-pubsub/svice/identify"
+	ps "github.com/jbenet/go-peerstream"
+	ms "github.com/whyrusleeping/go-multistream"
+)
+
+// IdentifyTimeout bounds how long the identify exchange on a new
+// connection may take.
+var IdentifyTimeout = 10 * time.Second
+
+// identifyConn asks the peer at the other end of a new connection about
+// itself. The peer does the same on its end.
+func (gw *Gateway) identifyConn(c *ps.Conn) {
+	mc, ok := c.Conn().(*muxConn)
+	if !ok {
+		return
+	}
+
+	s, err := gw.conns.NewStreamWithConn(c)
+	if err != nil {
+		return
+	}
+	defer s.Close()
+
+	timer := time.AfterFunc(IdentifyTimeout, func() { s.Close() })
+	defer timer.Stop()
+
+	// Protocol selection waits on the remote end, so it doubles as a
+	// rough round trip time sample.
+	start := time.Now()
+	err = ms.SelectProtoOrFail(identify.Proto, s)
+	if err != nil {
+		return
+	}
+	gw.peers.RecordLatency(mc.remoteID, time.Since(start))
+
+	gw.ident.Request(s, mc.remoteID)
+}
+
+// dialable tells whether a peer listening on addr could be dialed there.
+// Unspecified IPs like 0.0.0.0 only say which interfaces it listens on.
+func dialable(addr []byte) bool {
+	m, err := parseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip := addrIP(m)
+	return ip == nil || !ip.IsUnspecified()
+}
+
+func (gw *Gateway) handleIdentify(_ string, rwc io.ReadWriteCloser) error {
+	defer rwc.Close()
+
+	var observed []byte
+	if s, ok := rwc.(*ps.Stream); ok {
+		if m := remoteMultiaddr(s.Conn().NetConn()); m != nil {
+			observed = m.Bytes()
+		}
+	}
+	return gw.ident.Handle(rwc, observed)
+}
+
+// ListenAddrs returns the addresses the gateway listens on.
+func (gw *Gateway) ListenAddrs() [][]byte {
+	gw.listenAddrsmu.Lock()
+	defer gw.listenAddrsmu.Unlock()
+	return append([][]byte(nil), gw.listenAddrs...)
+}
+
+// Protocols returns the protocols the gateway handles.
+func (gw *Gateway) Protocols() []string {
+	return gw.router.Protocols()
+}
+
+// Peerstore returns what the gateway has learned about other peers.
+func (gw *Gateway) Peerstore() *peerstore.Peerstore {
+	return gw.peers
+}
+
+// ObservedAddrs returns the addresses that other peers have seen us at.
+func (gw *Gateway) ObservedAddrs() [][]byte {
+	return gw.ident.ObservedAddrs()
+}
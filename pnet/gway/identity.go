@@ -0,0 +1,84 @@
+package gway
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	mh "github.com/jbenet/go-multihash"
+)
+
+// Identity is the long-term keypair of a node. The peer ID of a node is
+// derived from its public key, so a peer can't claim an ID without holding
+// the matching private key.
+type Identity struct {
+	priv ed25519.PrivateKey
+	id   string
+}
+
+// GenerateIdentity creates a new random identity.
+func GenerateIdentity() (*Identity, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return newIdentity(priv)
+}
+
+// LoadIdentity reads an identity from the file at path. If the file doesn't
+// exist, a new identity is generated and saved there.
+func LoadIdentity(path string) (*Identity, error) {
+	seed, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		id, err := GenerateIdentity()
+		if err != nil {
+			return nil, err
+		}
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return nil, err
+		}
+		return id, ioutil.WriteFile(path, id.priv.Seed(), 0600)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("malformed identity file " + path)
+	}
+	return newIdentity(ed25519.NewKeyFromSeed(seed))
+}
+
+func newIdentity(priv ed25519.PrivateKey) (*Identity, error) {
+	id, err := IDFromPublicKey(priv.Public().(ed25519.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{priv, id}, nil
+}
+
+// ID returns the peer ID belonging to this identity.
+func (id *Identity) ID() string { return id.id }
+
+// PublicKey returns the public half of the keypair.
+func (id *Identity) PublicKey() ed25519.PublicKey {
+	return id.priv.Public().(ed25519.PublicKey)
+}
+
+// Sign signs msg with the private key.
+func (id *Identity) Sign(msg []byte) []byte {
+	return ed25519.Sign(id.priv, msg)
+}
+
+// IDFromPublicKey returns the peer ID of the given public key: the base58
+// encoded sha2-256 multihash of the key.
+func IDFromPublicKey(pub ed25519.PublicKey) (string, error) {
+	h, err := mh.Sum(pub, mh.SHA2_256, -1)
+	if err != nil {
+		return "", err
+	}
+	return h.B58String(), nil
+}
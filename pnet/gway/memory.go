@@ -0,0 +1,237 @@
+package gway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+// P_MEMORY is the multiaddr protocol code of in-memory addresses, like
+// /memory/alice. Gateways in the same process connect to them through
+// pipes, without any sockets, which makes them handy in tests.
+//
+// The vendored go-multiaddr can't parse protocols with a string value, so
+// memory addresses are recognized by the gateway before it, and only ever
+// made with MemoryAddr.
+const P_MEMORY = 777
+
+var memoryProtocol = ma.Protocol{
+	Code:  P_MEMORY,
+	Size:  ma.LengthPrefixedVarSize,
+	Name:  "memory",
+	VCode: ma.CodeToVarint(P_MEMORY),
+}
+
+// MemoryAddr returns the bytes of the address /memory/<name>. The name must
+// not be empty or contain slashes.
+func MemoryAddr(name string) []byte {
+	b := append([]byte(nil), memoryProtocol.VCode...)
+	b = append(b, ma.CodeToVarint(len(name))...)
+	return append(b, name...)
+}
+
+// parseAddr is ma.NewMultiaddrBytes that knows memory addresses too. A
+// memory address may only be followed by the rest of a circuit address, for
+// peers that are relayed by a gateway listening in memory.
+func parseAddr(bts []byte) (ma.Multiaddr, error) {
+	if !bytes.HasPrefix(bts, memoryProtocol.VCode) {
+		return ma.NewMultiaddrBytes(bts)
+	}
+
+	b := bts[len(memoryProtocol.VCode):]
+	size, n := ma.ReadVarintCode(b)
+	if n == 0 || size > len(b)-n {
+		return nil, errors.New("invalid memory address")
+	}
+	name, rest := string(b[n:n+size]), b[n+size:]
+	if name == "" || strings.Contains(name, "/") {
+		return nil, errors.New("invalid memory address")
+	}
+	if len(rest) == 0 {
+		return memoryMultiaddr(name), nil
+	}
+
+	c, err := ma.NewMultiaddrBytes(rest)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(c.String(), "/p2p-circuit") {
+		return nil, errors.New("only a circuit can follow a memory address")
+	}
+	return memoryCircuit{memoryMultiaddr(name), c}, nil
+}
+
+// parseAddrString is ma.NewMultiaddr that knows memory addresses too, but
+// not memory circuits.
+func parseAddrString(s string) (ma.Multiaddr, error) {
+	if !strings.HasPrefix(s, "/memory/") {
+		return ma.NewMultiaddr(s)
+	}
+	return parseAddr(MemoryAddr(strings.TrimPrefix(s, "/memory/")))
+}
+
+// memoryName returns the name of a memory address. ok is false if m isn't
+// one.
+func memoryName(m ma.Multiaddr) (name string, ok bool) {
+	mm, ok := m.(memoryMultiaddr)
+	return string(mm), ok
+}
+
+// memoryMultiaddr is a memory address by name.
+type memoryMultiaddr string
+
+func (m memoryMultiaddr) Equal(o ma.Multiaddr) bool {
+	return bytes.Equal(m.Bytes(), o.Bytes())
+}
+
+func (m memoryMultiaddr) Bytes() []byte            { return MemoryAddr(string(m)) }
+func (m memoryMultiaddr) String() string           { return "/memory/" + string(m) }
+func (m memoryMultiaddr) Protocols() []ma.Protocol { return []ma.Protocol{memoryProtocol} }
+
+// Encapsulate only takes a circuit, the one thing that may follow a memory
+// address. Anything else leaves m unchanged.
+func (m memoryMultiaddr) Encapsulate(o ma.Multiaddr) ma.Multiaddr {
+	e, err := parseAddr(append(m.Bytes(), o.Bytes()...))
+	if err != nil {
+		return m
+	}
+	return e
+}
+
+// Decapsulate returns m unchanged, since the vendored go-multiaddr has no
+// empty address to return when o is m.
+func (m memoryMultiaddr) Decapsulate(ma.Multiaddr) ma.Multiaddr { return m }
+
+// memoryCircuit is a circuit address through a relay that listens in
+// memory.
+type memoryCircuit struct {
+	relay   memoryMultiaddr
+	circuit ma.Multiaddr // /ipfs/<relay ID>/p2p-circuit
+}
+
+func (m memoryCircuit) Equal(o ma.Multiaddr) bool {
+	return bytes.Equal(m.Bytes(), o.Bytes())
+}
+
+func (m memoryCircuit) Bytes() []byte {
+	return append(m.relay.Bytes(), m.circuit.Bytes()...)
+}
+
+func (m memoryCircuit) String() string { return m.relay.String() + m.circuit.String() }
+
+func (m memoryCircuit) Protocols() []ma.Protocol {
+	return append(m.relay.Protocols(), m.circuit.Protocols()...)
+}
+
+// Encapsulate returns m unchanged, since nothing may follow a circuit.
+func (m memoryCircuit) Encapsulate(ma.Multiaddr) ma.Multiaddr { return m }
+
+// Decapsulate unwraps the circuit, leaving the address of the relay, if o
+// is the circuit or a part of it from the start. Otherwise m is returned
+// unchanged, since there's no other address it could be cut down to.
+func (m memoryCircuit) Decapsulate(o ma.Multiaddr) ma.Multiaddr {
+	if strings.HasPrefix(m.circuit.String(), o.String()) {
+		return m.relay
+	}
+	return m
+}
+
+// memoryAddr is the net.Addr of the ends of an in-memory connection.
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return memoryMultiaddr(a).String() }
+
+// memoryListeners are the memory addresses listened on in this process.
+var memoryListeners = struct {
+	byName map[string]*memoryListener
+	dials  int
+	sync.Mutex
+}{byName: make(map[string]*memoryListener)}
+
+type memoryListener struct {
+	name   string
+	conns  chan net.Conn
+	closed chan bool
+	once   sync.Once
+}
+
+func listenMemory(name string) (*memoryListener, error) {
+	memoryListeners.Lock()
+	defer memoryListeners.Unlock()
+
+	if _, ok := memoryListeners.byName[name]; ok {
+		return nil, errors.New("memory address /memory/" + name + " is in use")
+	}
+	l := &memoryListener{
+		name:   name,
+		conns:  make(chan net.Conn),
+		closed: make(chan bool),
+	}
+	memoryListeners.byName[name] = l
+	return l, nil
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("memory listener is closed")
+	}
+}
+
+// Close frees the name of the listener for others to listen on.
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		memoryListeners.Lock()
+		delete(memoryListeners.byName, l.name)
+		memoryListeners.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr { return memoryAddr(l.name) }
+
+// dialMemory connects to the listener of name with a pipe. The dialing end
+// gets a name of its own, so that the listener can tell its peers apart.
+func dialMemory(ctx context.Context, name string) (net.Conn, error) {
+	memoryListeners.Lock()
+	l, ok := memoryListeners.byName[name]
+	memoryListeners.dials++
+	laddr := memoryAddr("dial-" + strconv.Itoa(memoryListeners.dials))
+	memoryListeners.Unlock()
+	if !ok {
+		return nil, errors.New("nothing listens on /memory/" + name)
+	}
+
+	c1, c2 := net.Pipe()
+	select {
+	case l.conns <- &memoryConn{c2, memoryAddr(name), laddr}:
+		return &memoryConn{c1, laddr, memoryAddr(name)}, nil
+	case <-l.closed:
+		c1.Close()
+		c2.Close()
+		return nil, errors.New("memory listener is closed")
+	case <-ctx.Done():
+		c1.Close()
+		c2.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// memoryConn reports memory addresses instead of those of the pipe.
+type memoryConn struct {
+	net.Conn
+	laddr, raddr memoryAddr
+}
+
+func (c *memoryConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *memoryConn) RemoteAddr() net.Addr { return c.raddr }
@@ -0,0 +1,43 @@
+package gway
+
+import (
+	"testing"
+
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+func TestMemoryLayers(t *testing.T) {
+	c, err := ma.NewMultiaddr("/ipfs/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN/p2p-circuit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseAddr(MemoryAddr("layers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mc := m.Encapsulate(c)
+	if _, ok := mc.(memoryCircuit); !ok || mc.String() != m.String()+c.String() {
+		t.Fatalf("expected the circuit %s%s, got %s", m, c, mc)
+	}
+	if e := m.Encapsulate(tcp); !e.Equal(m) {
+		t.Fatalf("expected %s unchanged, got %s", m, e)
+	}
+	if e := mc.Encapsulate(tcp); !e.Equal(mc) {
+		t.Fatalf("expected %s unchanged, got %s", mc, e)
+	}
+
+	if d := mc.Decapsulate(c); !d.Equal(m) {
+		t.Fatalf("expected %s, got %s", m, d)
+	}
+	if d := mc.Decapsulate(tcp); !d.Equal(mc) {
+		t.Fatalf("expected %s unchanged, got %s", mc, d)
+	}
+	if d := m.Decapsulate(m); !d.Equal(m) {
+		t.Fatalf("expected %s unchanged, got %s", m, d)
+	}
+}
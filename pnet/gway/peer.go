@@ -1,5 +1,7 @@
 package gway
 
+import "github.com/Gaboose/go-pubsub/pnet"
+
 // PeerInfo is a small struct used to pass around between
 // topo subpackages. It implements topo.Peer interface.
 type PeerInfo struct {
@@ -11,6 +13,16 @@ type PeerInfo struct {
 func (p PeerInfo) Id() interface{}          { return p.ID }
 func (p PeerInfo) Get(k string) interface{} { return p.Params[k] }
 
+// Copy returns a copy of p with a map of params of its own.
+func (p *PeerInfo) Copy() pnet.Peer {
+	cp := *p
+	cp.Params = make(map[string]interface{}, len(p.Params))
+	for k, v := range p.Params {
+		cp.Params[k] = v
+	}
+	return &cp
+}
+
 func (p *PeerInfo) Put(k string, v interface{}) {
 	if p.Params == nil {
 		p.Params = make(map[string]interface{})
@@ -1,68 +1,217 @@
 package gway
 
 import (
+	"context"
 	"errors"
 	"io"
+	"sync"
 
 	"github.com/Gaboose/go-pubsub/pnet"
+	"github.com/Gaboose/go-pubsub/pnet/peerstore"
+)
+
+// Errors returned by listeners once they, or their ProtoNet, are closed,
+// and by a listener that another one is active in the way of.
+var (
+	ErrProtoNetClosed   = errors.New("ProtoNet is closed")
+	ErrListenerClosed   = errors.New("Listener is closed")
+	ErrAlreadyListening = errors.New("ProtoNet already has an active listener")
 )
 
 type ProtoNet struct {
-	proto    string
-	acceptCh chan io.ReadWriteCloser
-	closeCh  chan bool
-	gw       *Gateway
+	proto     string
+	match     MatchFunc
+	fallbacks []string
+	closeCh   chan bool
+	gw        *Gateway
+
+	ln   *listener // the active listener, if any
+	lnmu sync.Mutex
 }
 
 func (pn *ProtoNet) Dial(p pnet.Peer) (io.ReadWriteCloser, error) {
-	return pn.gw.Dial(p, pn.proto)
+	return pn.DialContext(context.Background(), p)
+}
+
+// DialContext proposes the protocol of the ProtoNet first and then its
+// fallbacks, if it has any.
+func (pn *ProtoNet) DialContext(ctx context.Context, p pnet.Peer) (io.ReadWriteCloser, error) {
+	protos := append([]string{pn.proto}, pn.fallbacks...)
+	return pn.gw.dialProtos(ctx, p, protos)
+}
+
+// Peerstore returns the peerstore of the gateway, so that topo packages can
+// share what they learn about peers.
+func (pn *ProtoNet) Peerstore() *peerstore.Peerstore {
+	return pn.gw.peers
+}
+
+// Protect keeps the connections with p from being trimmed until it's
+// unprotected with the same tag.
+func (pn *ProtoNet) Protect(p pnet.Peer, tag string) {
+	if id, ok := p.Id().(string); ok {
+		pn.gw.Protect(id, tag)
+	}
+}
+
+func (pn *ProtoNet) Unprotect(p pnet.Peer, tag string) {
+	if id, ok := p.Id().(string); ok {
+		pn.gw.Unprotect(id, tag)
+	}
 }
 
+// Listen starts handling the protocol. A ProtoNet has one active listener
+// at most: a second one fails to Accept with ErrAlreadyListening until the
+// first is closed. Without an active listener, streams of the protocol are
+// turned away while they negotiate it.
 func (pn *ProtoNet) Listen() pnet.Listener {
-	return &listener{
-		acceptCh: pn.acceptCh,
+	pn.lnmu.Lock()
+	defer pn.lnmu.Unlock()
+
+	select {
+	case <-pn.closeCh:
+		return errListener{ErrProtoNetClosed}
+	default:
+	}
+	if pn.ln != nil {
+		return errListener{ErrAlreadyListening}
+	}
+
+	ln := &listener{
+		acceptCh: make(chan io.ReadWriteCloser),
 		closeCh:  make(chan bool),
+		pn:       pn,
+	}
+	pn.ln = ln
+	pn.gw.router.AddHandlerMatch(pn.proto, pn.match, ln.handle)
+	return ln
+}
+
+// release stops handling the protocol if ln is the active listener.
+func (pn *ProtoNet) release(ln *listener) {
+	pn.lnmu.Lock()
+	defer pn.lnmu.Unlock()
+
+	if pn.ln == ln {
+		pn.ln = nil
+		pn.gw.router.RemoveHandler(pn.proto)
 	}
 }
 
+// Close stops handling the protocol. The active listener returns
+// ErrProtoNetClosed from then on, as do any later ones.
 func (pn *ProtoNet) Close() error {
 	var err error
 	func() {
 		defer recoverError(&err, errors.New("ProtNet already closed"))
 		close(pn.closeCh)
 	}()
-	return err
+	if err != nil {
+		return err
+	}
+
+	pn.lnmu.Lock()
+	if pn.ln != nil {
+		pn.ln = nil
+		pn.gw.router.RemoveHandler(pn.proto)
+	}
+	pn.lnmu.Unlock()
+
+	pn.gw.protonetsmu.Lock()
+	delete(pn.gw.protonets, pn)
+	pn.gw.protonetsmu.Unlock()
+	return nil
 }
 
 type listener struct {
 	acceptCh chan io.ReadWriteCloser
 	closeCh  chan bool
+	pn       *ProtoNet
+}
+
+// handle passes a stream of proto on to Accept. If the listener is closed
+// first, the stream is closed right away.
+func (ln *listener) handle(proto string, rwc io.ReadWriteCloser) error {
+	var err error
+	select {
+	case ln.acceptCh <- ln.pn.gw.meterStream(rwc, proto):
+		return nil
+	case <-ln.closeCh:
+		err = ErrListenerClosed
+	case <-ln.pn.closeCh:
+		err = ErrProtoNetClosed
+	}
+	rwc.Close()
+	return err
 }
 
 func (ln *listener) Accept() (io.ReadWriteCloser, error) {
+	return ln.AcceptContext(context.Background())
+}
+
+func (ln *listener) AcceptContext(ctx context.Context) (io.ReadWriteCloser, error) {
 	select {
-	case s, ok := <-ln.acceptCh:
-		if !ok {
-			return nil, errors.New("ProtoNet is closed")
-		}
+	case s := <-ln.acceptCh:
 		return s, nil
+	case <-ln.pn.closeCh:
+		return nil, ErrProtoNetClosed
 	case <-ln.closeCh:
-		return nil, errors.New("Listener is closed")
+		return nil, ErrListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
+// Close makes way for another listener.
 func (ln *listener) Close() error {
 	var err error
 	func() {
 		defer recoverError(&err, errors.New("Listener already closed"))
 		close(ln.closeCh)
 	}()
-	return err
+	if err != nil {
+		return err
+	}
+
+	ln.pn.release(ln)
+	return nil
 }
 
+// errListener fails to accept anything.
+type errListener struct {
+	err error
+}
+
+func (ln errListener) Accept() (io.ReadWriteCloser, error) { return nil, ln.err }
+
+func (ln errListener) AcceptContext(context.Context) (io.ReadWriteCloser, error) {
+	return nil, ln.err
+}
+
+func (ln errListener) Close() error { return nil }
+
 func recoverError(maybeErr *error, err error) {
 	r := recover()
 	if r != nil {
 		*maybeErr = err
 	}
 }
+
+// ProtoDialer dials a protocol without listening on it, for protocols that
+// the gateway handles itself.
+type ProtoDialer struct {
+	proto string
+	gw    *Gateway
+}
+
+func (pd *ProtoDialer) Dial(p pnet.Peer) (io.ReadWriteCloser, error) {
+	return pd.gw.Dial(p, pd.proto)
+}
+
+func (pd *ProtoDialer) DialContext(ctx context.Context, p pnet.Peer) (io.ReadWriteCloser, error) {
+	return pd.gw.DialContext(ctx, p, pd.proto)
+}
+
+func (pd *ProtoDialer) Peerstore() *peerstore.Peerstore {
+	return pd.gw.peers
+}
@@ -6,18 +6,14 @@ import (
 	"testing"
 
 	"github.com/Gaboose/go-pubsub/pnet"
-	ma "github.com/jbenet/go-multiaddr"
 )
 
 func TestRouter(t *testing.T) {
-	m, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/8001")
-	if err != nil {
-		t.Fatal(err)
-	}
+	m := MemoryAddr("router")
 
 	gw1 := NewGateway()
 	defer gw1.Close()
-	err = gw1.ListenAll([][]byte{m.Bytes()})
+	err := gw1.ListenAll([][]byte{m})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -60,8 +56,8 @@ func TestRouter(t *testing.T) {
 	}
 
 	dest := &PeerInfo{
-		ID:     "bob",
-		MAddrs: [][]byte{m.Bytes()},
+		ID:     gw1.ID(),
+		MAddrs: [][]byte{m},
 	}
 
 	toReadFoo := dialAndRead(pn2foo, dest)
@@ -77,33 +73,148 @@ func TestRouter(t *testing.T) {
 }
 
 func TestBadProto(t *testing.T) {
-	m, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/8002")
+	m := MemoryAddr("badproto")
+
+	gw1 := NewGateway()
+	defer gw1.Close()
+	err := gw1.ListenAll([][]byte{m})
 	if err != nil {
 		t.Fatal(err)
 	}
+	pn1 := gw1.NewProtoNet("/foo")
+	defer pn1.Close()
+
+	gw2 := NewGateway()
+	defer gw2.Close()
+	pn2 := gw2.NewProtoNet("/bar")
+	defer pn2.Close()
+
+	dest := &PeerInfo{
+		ID:     gw1.ID(),
+		MAddrs: [][]byte{m},
+	}
+
+	_, err = pn2.Dial(dest)
+
+	if err == nil {
+		t.Fatal("expected error from ProtoNet.Dial, got nil")
+	}
+}
+
+func TestListenOnce(t *testing.T) {
+	m := MemoryAddr("listenonce")
 
 	gw1 := NewGateway()
 	defer gw1.Close()
-	err = gw1.ListenAll([][]byte{m.Bytes()})
+	err := gw1.ListenAll([][]byte{m})
 	if err != nil {
 		t.Fatal(err)
 	}
 	pn1 := gw1.NewProtoNet("/foo")
 	defer pn1.Close()
 
+	ln1 := pn1.Listen()
+	_, err = pn1.Listen().Accept()
+	if err != ErrAlreadyListening {
+		t.Fatalf("expected ErrAlreadyListening, got %v", err)
+	}
+
 	gw2 := NewGateway()
 	defer gw2.Close()
-	pn2 := gw2.NewProtoNet("/bar")
+	pn2 := gw2.NewProtoNet("/foo")
 	defer pn2.Close()
 
 	dest := &PeerInfo{
-		ID:     "bob",
-		MAddrs: [][]byte{m.Bytes()},
+		ID:     gw1.ID(),
+		MAddrs: [][]byte{m},
 	}
 
+	// Streams are turned away once the listener is closed
+	ln1.Close()
 	_, err = pn2.Dial(dest)
-
 	if err == nil {
 		t.Fatal("expected error from ProtoNet.Dial, got nil")
 	}
+
+	// And accepted again by a new one
+	ln2 := pn1.Listen()
+	defer ln2.Close()
+	go func() {
+		s, err := ln2.Accept()
+		if err == nil {
+			s.Close()
+		}
+	}()
+	s, err := pn2.Dial(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+func TestVersions(t *testing.T) {
+	m := MemoryAddr("versions")
+
+	gw1 := NewGateway()
+	defer gw1.Close()
+	err := gw1.ListenAll([][]byte{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pn1 := gw1.NewProtoNetMatch("/foo/1.1.0", SemverMatch("/foo/1.1.0"))
+	defer pn1.Close()
+	ln1 := pn1.Listen()
+	defer ln1.Close()
+
+	accepted := make(chan string, 1)
+	go func() {
+		for {
+			s, err := ln1.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- s.(pnet.ProtocolStream).Protocol()
+			s.Close()
+		}
+	}()
+
+	gw2 := NewGateway()
+	defer gw2.Close()
+	dest := &PeerInfo{
+		ID:     gw1.ID(),
+		MAddrs: [][]byte{m},
+	}
+
+	dial := func(pn *ProtoNet) string {
+		defer pn.Close()
+		s, err := pn.Dial(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		return s.(pnet.ProtocolStream).Protocol()
+	}
+
+	// A newer node accepts an older version
+	if p := dial(gw2.NewProtoNet("/foo/1.0.0")); p != "/foo/1.0.0" {
+		t.Fatalf("dialed %s, expected /foo/1.0.0", p)
+	}
+	if p := <-accepted; p != "/foo/1.0.0" {
+		t.Fatalf("accepted %s, expected /foo/1.0.0", p)
+	}
+
+	// An even newer one falls back to a version we know
+	pn := gw2.NewProtoNetMatch("/foo/1.2.0", nil, "/foo/1.1.0")
+	if p := dial(pn); p != "/foo/1.1.0" {
+		t.Fatalf("dialed %s, expected /foo/1.1.0", p)
+	}
+	if p := <-accepted; p != "/foo/1.1.0" {
+		t.Fatalf("accepted %s, expected /foo/1.1.0", p)
+	}
+
+	// But not to an incompatible one
+	_, err = gw2.NewProtoNet("/foo/2.0.0").Dial(dest)
+	if err == nil {
+		t.Fatal("expected error dialing /foo/2.0.0, got nil")
+	}
 }
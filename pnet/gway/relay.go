@@ -0,0 +1,171 @@
+package gway
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Gaboose/go-pubsub/svice/relay"
+	ma "github.com/jbenet/go-multiaddr"
+	ps "github.com/jbenet/go-peerstream"
+)
+
+// P_CIRCUIT is the multiaddr protocol code of relayed addresses. A peer
+// reachable through a relay lists an address like
+// /ip4/1.2.3.4/tcp/4002/ipfs/<relay ID>/p2p-circuit. The part before /ipfs
+// may be left out if the relay is connected already.
+const P_CIRCUIT = 290
+
+func init() {
+	ma.Protocols = append(ma.Protocols, ma.Protocol{
+		Code:  P_CIRCUIT,
+		Size:  0,
+		Name:  "p2p-circuit",
+		VCode: ma.CodeToVarint(P_CIRCUIT),
+	})
+}
+
+// CircuitAddr returns the addresses of a peer reachable through the relay
+// r, one for each of r's. Those of r that can't be parsed are left out.
+func CircuitAddr(r *PeerInfo) [][]byte {
+	c, err := ma.NewMultiaddr("/ipfs/" + r.ID + "/p2p-circuit")
+	if err != nil {
+		return nil
+	}
+
+	var addrs [][]byte
+	for _, bts := range r.MAddrs {
+		m, err := parseAddr(bts)
+		if err != nil {
+			continue
+		}
+		// Appending the bytes encapsulates memory addresses too
+		addrs = append(addrs, append(m.Bytes(), c.Bytes()...))
+	}
+	return addrs
+}
+
+// splitCircuit returns the address and the ID of the relay in a circuit
+// address. ok is false if m isn't one.
+func splitCircuit(m ma.Multiaddr) (raddr []byte, rid string, ok bool) {
+	s := m.String()
+	if !strings.HasSuffix(s, "/p2p-circuit") {
+		return nil, "", false
+	}
+	s = strings.TrimSuffix(s, "/p2p-circuit")
+
+	i := strings.LastIndex(s, "/ipfs/")
+	if i < 0 {
+		return nil, "", false
+	}
+	rid = s[i+len("/ipfs/"):]
+
+	if i > 0 {
+		rm, err := parseAddrString(s[:i])
+		if err != nil {
+			return nil, "", false
+		}
+		raddr = rm.Bytes()
+	}
+	return raddr, rid, true
+}
+
+// IsCircuit tells if bts is a relayed address.
+func IsCircuit(bts []byte) bool {
+	m, err := parseAddr(bts)
+	if err != nil {
+		return false
+	}
+	_, _, ok := splitCircuit(m)
+	return ok
+}
+
+// dialRelay asks the relay rid, at raddr, to connect us with the peer dst.
+func (gw *Gateway) dialRelay(ctx context.Context, raddr []byte, rid, dst string) (net.Conn, error) {
+	r := &PeerInfo{ID: rid}
+	if raddr != nil {
+		r.MAddrs = [][]byte{raddr}
+	}
+
+	s, err := gw.DialContext(ctx, r, relay.HopProto)
+	if err != nil {
+		return nil, err
+	}
+
+	err = relay.Connect(ctx, s, dst)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return newStreamConn(s, rid), nil
+}
+
+// handleRelayed takes a stream from a relay as a new connection. It's
+// authenticated and encrypted end to end like any other.
+func (gw *Gateway) handleRelayed(_ string, rwc io.ReadWriteCloser) error {
+	var rid string
+	if s, ok := rwc.(*ps.Stream); ok {
+		if mc, ok := s.Conn().Conn().(*muxConn); ok {
+			rid = mc.remoteID
+		}
+	}
+
+	// The swarm takes the client's side of the conns it's given, so
+	// upgrade it here as the server.
+	ac, err := gw.upgrade(context.Background(), newStreamConn(rwc, rid), "", true)
+	if err != nil {
+		rwc.Close()
+		return err
+	}
+
+	_, err = gw.conns.AddConn(ac)
+	if err != nil {
+		ac.Close()
+	}
+	return err
+}
+
+// streamConn lets a relayed stream stand in for a net.Conn. Streams don't
+// have deadlines, so one that expires closes the stream instead.
+type streamConn struct {
+	io.ReadWriteCloser
+	addr circuitAddr
+
+	timer   *time.Timer
+	timermu sync.Mutex
+}
+
+func newStreamConn(rwc io.ReadWriteCloser, rid string) *streamConn {
+	return &streamConn{ReadWriteCloser: rwc, addr: circuitAddr(rid)}
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.addr }
+func (c *streamConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.timermu.Lock()
+	defer c.timermu.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !t.IsZero() {
+		c.timer = time.AfterFunc(t.Sub(time.Now()), func() {
+			c.Close()
+		})
+	}
+	return nil
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return c.SetDeadline(t) }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+// circuitAddr is the net.Addr of a relayed connection: the relay's ID.
+type circuitAddr string
+
+func (a circuitAddr) Network() string { return "p2p-circuit" }
+func (a circuitAddr) String() string  { return "/ipfs/" + string(a) + "/p2p-circuit" }
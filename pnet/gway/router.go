@@ -0,0 +1,156 @@
+package gway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+
+	ms "github.com/whyrusleeping/go-multistream"
+)
+
+// handlerFunc takes a stream that proto was negotiated on.
+type handlerFunc func(proto string, rwc io.ReadWriteCloser) error
+
+// MatchFunc tells if a protocol proposed by a dialer can be handled.
+type MatchFunc func(proto string) bool
+
+type route struct {
+	proto   string
+	match   MatchFunc
+	handler handlerFunc
+}
+
+// router is a go-multistream muxer whose handlers can take more than their
+// exact protocol name, e.g. older versions of it.
+type router struct {
+	routes map[string]route
+	mu     sync.Mutex
+}
+
+func newRouter() *router {
+	return &router{routes: make(map[string]route)}
+}
+
+// AddHandler handles exactly proto.
+func (r *router) AddHandler(proto string, h handlerFunc) {
+	r.AddHandlerMatch(proto, nil, h)
+}
+
+// AddHandlerMatch handles proto and every protocol that match accepts. An
+// exact name is preferred over a match.
+func (r *router) AddHandlerMatch(proto string, match MatchFunc, h handlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[proto] = route{proto, match, h}
+}
+
+func (r *router) RemoveHandler(proto string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.routes, proto)
+}
+
+// Protocols returns the names that the handlers were added with.
+func (r *router) Protocols() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	protos := make([]string, 0, len(r.routes))
+	for p := range r.routes {
+		protos = append(protos, p)
+	}
+	sort.Strings(protos)
+	return protos
+}
+
+func (r *router) lookup(proto string) (handlerFunc, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if rt, ok := r.routes[proto]; ok {
+		return rt.handler, true
+	}
+	for _, name := range r.sorted() {
+		rt := r.routes[name]
+		if rt.match != nil && rt.match(proto) {
+			return rt.handler, true
+		}
+	}
+	return nil, false
+}
+
+// sorted returns the route names in order, so that matching doesn't depend
+// on map iteration. The caller must hold mu.
+func (r *router) sorted() []string {
+	names := make([]string, 0, len(r.routes))
+	for name := range r.routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Handle negotiates a protocol on rwc like go-multistream does and passes
+// rwc on to its handler.
+func (r *router) Handle(rwc io.ReadWriteCloser) error {
+	err := delimWrite(rwc, ms.ProtocolID)
+	if err != nil {
+		return err
+	}
+
+	tok, err := ms.ReadNextToken(rwc)
+	if err != nil {
+		return err
+	}
+	if tok != ms.ProtocolID {
+		rwc.Close()
+		return errors.New("client connected with incorrect version")
+	}
+
+	for {
+		tok, err := ms.ReadNextToken(rwc)
+		if err != nil {
+			return err
+		}
+
+		if tok == "ls" {
+			var buf bytes.Buffer
+			for _, p := range r.Protocols() {
+				delimWrite(&buf, p)
+			}
+			err = delimWrite(rwc, buf.String())
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		h, ok := r.lookup(tok)
+		if !ok {
+			err = delimWrite(rwc, "na")
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = delimWrite(rwc, tok)
+		if err != nil {
+			return err
+		}
+		return h(tok, rwc)
+	}
+}
+
+// delimWrite writes a go-multistream message in a single Write.
+func delimWrite(w io.Writer, msg string) error {
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(msg)+1)
+	n := binary.PutUvarint(buf, uint64(len(msg)+1))
+	buf = append(buf[:n], msg...)
+	buf = append(buf, '\n')
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,48 @@
+package gway
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSecureConn(t *testing.T) {
+	id1, _ := GenerateIdentity()
+	id2, _ := GenerateIdentity()
+	c1, c2 := net.Pipe()
+
+	done := make(chan *authConn)
+	go func() {
+		ac, err := secureHandshake(c2, id2, id1.ID())
+		if err != nil {
+			t.Error(err)
+		}
+		done <- ac
+	}()
+
+	ac1, err := secureHandshake(c1, id1, id2.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac2 := <-done
+	if ac2 == nil {
+		t.FailNow()
+	}
+
+	// Spans several frames
+	toWrite := make([]byte, 3*maxFrame+1)
+	rand.Read(toWrite)
+	go func() {
+		ac1.Write(toWrite)
+		ac1.Close()
+	}()
+
+	var toRead bytes.Buffer
+	io.Copy(&toRead, ac2)
+
+	if !bytes.Equal(toWrite, toRead.Bytes()) {
+		t.Fatalf("written %d bytes, but read %d different ones", len(toWrite), toRead.Len())
+	}
+}
@@ -0,0 +1,185 @@
+package gway
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	smux "github.com/jbenet/go-stream-muxer"
+	multiplex "github.com/jbenet/go-stream-muxer/multiplex"
+	muxado "github.com/jbenet/go-stream-muxer/muxado"
+	spdy "github.com/jbenet/go-stream-muxer/spdystream"
+	yamux "github.com/jbenet/go-stream-muxer/yamux"
+	ms "github.com/whyrusleeping/go-multistream"
+)
+
+// Security protocols, negotiated with go-multistream on every new connection.
+const (
+	SecureProto    = "/secure/1.0.0"
+	PlaintextProto = "/plaintext/1.0.0"
+)
+
+// Muxers are the stream muxers a gateway can negotiate, by their
+// multistream protocol names.
+var Muxers = map[string]smux.Transport{
+	"/yamux":      yamux.DefaultTransport,
+	"/spdystream": spdy.Transport,
+	"/multiplex":  multiplex.DefaultTransport,
+	"/muxado":     muxado.Transport,
+}
+
+// DefaultMuxers is the muxer preference list used when Config.Muxers is nil.
+var DefaultMuxers = []string{"/yamux", "/spdystream", "/multiplex", "/muxado"}
+
+// UpgradeTimeout bounds how long a new connection may take to negotiate
+// its security protocol and stream muxer, and to authenticate itself.
+var UpgradeTimeout = 10 * time.Second
+
+// upgrade negotiates a security protocol on a fresh connection and runs its
+// handshake. Then it negotiates a stream muxer over the secured connection.
+// isServer tells which side of the negotiations we're on.
+//
+// The gater, if there's one, is asked about inbound connections before the
+// handshake, and about all of them after it.
+func (gw *Gateway) upgrade(ctx context.Context, nc net.Conn, expect string, isServer bool) (*authConn, error) {
+	gater := gw.cfg.Gater
+	if isServer && gater != nil && !gater.InterceptAccept(remoteMultiaddr(nc)) {
+		return nil, ErrGated
+	}
+
+	defer guard(ctx, nc)()
+
+	proto, err := negotiate(nc, gw.securityProtos(), isServer)
+	if err != nil {
+		return nil, upgradeErr(ctx, err)
+	}
+
+	var ac *authConn
+	switch proto {
+	case SecureProto:
+		ac, err = secureHandshake(nc, gw.id, expect)
+	case PlaintextProto:
+		ac, _, err = handshake(nc, gw.id, expect, nil)
+	default:
+		err = errors.New("unknown security protocol " + proto)
+	}
+	if err != nil {
+		return nil, upgradeErr(ctx, err)
+	}
+	if gater != nil && !gater.InterceptSecured(isServer, ac.remoteID, remoteMultiaddr(nc)) {
+		return nil, ErrGated
+	}
+
+	ac.muxer, err = negotiate(ac, gw.muxers(), isServer)
+	if err != nil {
+		return nil, upgradeErr(ctx, err)
+	}
+	ac.isServer = isServer
+	return ac, nil
+}
+
+func (gw *Gateway) securityProtos() []string {
+	if gw.cfg.Insecure {
+		return []string{PlaintextProto}
+	}
+	return []string{SecureProto}
+}
+
+func (gw *Gateway) muxers() []string {
+	if gw.cfg.Muxers == nil {
+		return DefaultMuxers
+	}
+
+	var protos []string
+	for _, p := range gw.cfg.Muxers {
+		if _, ok := Muxers[p]; ok {
+			protos = append(protos, p)
+		}
+	}
+	return protos
+}
+
+// negotiate agrees on one of protos with the other end of nc. The client
+// proposes them in order of preference and the server picks the first one
+// it supports.
+func negotiate(nc net.Conn, protos []string, isServer bool) (string, error) {
+	if !isServer {
+		return ms.SelectOneOf(protos, nc)
+	}
+
+	router := ms.NewMultistreamMuxer()
+	for _, p := range protos {
+		router.AddHandler(p, nil)
+	}
+	proto, _, err := router.Negotiate(nc)
+	return proto, err
+}
+
+// guard gives nc UpgradeTimeout to complete a handshake and cuts it short
+// if ctx is done first. The returned function lifts the deadline.
+func guard(ctx context.Context, nc net.Conn) func() {
+	nc.SetDeadline(time.Now().Add(UpgradeTimeout))
+
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			nc.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		nc.SetDeadline(time.Time{})
+	}
+}
+
+func upgradeErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// transport is the smux.Transport handed to the peerstream swarm. It makes
+// sure every connection is authenticated before any streams are opened
+// over it.
+type transport struct {
+	gw *Gateway
+}
+
+// NewConn upgrades nc, unless that has already been done while dialing,
+// and starts the negotiated stream muxer on top of it. An upgraded nc keeps
+// the side it was upgraded on, whatever isServer says.
+func (t transport) NewConn(nc net.Conn, isServer bool) (smux.Conn, error) {
+	ac, ok := nc.(*authConn)
+	if ok {
+		isServer = ac.isServer
+	} else {
+		var err error
+		ac, err = t.gw.upgrade(context.Background(), nc, "", isServer)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+
+	sc, err := Muxers[ac.muxer].NewConn(ac, isServer)
+	if err != nil {
+		ac.Close()
+		return nil, err
+	}
+	return &muxConn{sc, ac.remoteID, ac.muxer, isServer}, nil
+}
+
+// muxConn remembers which peer a muxed connection belongs to, so that the
+// swarm's connection handler can group it by peer ID, and which side
+// opened it.
+type muxConn struct {
+	smux.Conn
+	remoteID string
+	muxer    string
+	inbound  bool
+}
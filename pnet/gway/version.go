@@ -0,0 +1,56 @@
+package gway
+
+import (
+	"strconv"
+	"strings"
+)
+
+// SemverMatch returns a MatchFunc for proto, a protocol name that ends with
+// a semantic version, like /cyclon/1.1.0. It takes the same protocol at any
+// version with the same major number that isn't newer than proto, because
+// those are the ones we can still talk to. Below 1.0.0, the minor number has
+// to be the same too. It panics if proto has no version.
+func SemverMatch(proto string) MatchFunc {
+	base, ours, ok := splitVersion(proto)
+	if !ok {
+		panic("protocol " + proto + " has no semantic version")
+	}
+
+	return func(p string) bool {
+		b, theirs, ok := splitVersion(p)
+		if !ok || b != base || theirs[0] != ours[0] {
+			return false
+		}
+		if ours[0] == 0 && theirs[1] != ours[1] {
+			return false
+		}
+		for i := 1; i < 3; i++ {
+			if theirs[i] != ours[i] {
+				return theirs[i] < ours[i]
+			}
+		}
+		return true
+	}
+}
+
+// splitVersion splits a protocol name like /cyclon/1.1.0 into its base,
+// /cyclon, and the version numbers.
+func splitVersion(proto string) (base string, version [3]int, ok bool) {
+	i := strings.LastIndex(proto, "/")
+	if i < 0 {
+		return "", version, false
+	}
+
+	nums := strings.Split(proto[i+1:], ".")
+	if len(nums) != 3 {
+		return "", version, false
+	}
+	for j, s := range nums {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return "", version, false
+		}
+		version[j] = n
+	}
+	return proto[:i], version, true
+}
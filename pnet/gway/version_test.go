@@ -0,0 +1,34 @@
+package gway
+
+import "testing"
+
+func TestSemverMatch(t *testing.T) {
+	match := SemverMatch("/foo/1.2.3")
+	for p, want := range map[string]bool{
+		"/foo/1.2.3": true,
+		"/foo/1.2.0": true,
+		"/foo/1.0.9": true,
+		"/foo/1.2.4": false,
+		"/foo/1.3.0": false,
+		"/foo/2.0.0": false,
+		"/foo/0.9.0": false,
+		"/bar/1.2.3": false,
+		"/foo":       false,
+		"/foo/1.x.0": false,
+	} {
+		if got := match(p); got != want {
+			t.Errorf("match(%q) = %v, expected %v", p, got, want)
+		}
+	}
+
+	// Below 1.0.0, minor versions aren't compatible
+	match = SemverMatch("/foo/0.2.1")
+	for p, want := range map[string]bool{
+		"/foo/0.2.0": true,
+		"/foo/0.1.0": false,
+	} {
+		if got := match(p); got != want {
+			t.Errorf("match(%q) = %v, expected %v", p, got, want)
+		}
+	}
+}
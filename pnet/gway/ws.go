@@ -0,0 +1,150 @@
+package gway
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	ma "github.com/jbenet/go-multiaddr"
+	"golang.org/x/net/websocket"
+)
+
+// P_WS is the multiaddr protocol code of websockets. A /ws address is the
+// tcp address of an http server, e.g. /ip4/1.2.3.4/tcp/80/ws.
+const P_WS = 477
+
+var wsMAddr ma.Multiaddr
+
+// Timeouts of the http server that websocket connections are accepted with.
+// WSReadHeaderTimeout and WSReadTimeout bound how long the request that
+// opens a connection may take to arrive, so that clients that never finish
+// it don't hold on to a socket. WSIdleTimeout is how long a keep-alive
+// connection may wait for its next request. None of them apply to the
+// websocket connection once it's open.
+var (
+	WSReadHeaderTimeout = 10 * time.Second
+	WSReadTimeout       = 30 * time.Second
+	WSIdleTimeout       = time.Minute
+)
+
+func init() {
+	ma.Protocols = append(ma.Protocols, ma.Protocol{
+		Code:  P_WS,
+		Size:  0,
+		Name:  "ws",
+		VCode: ma.CodeToVarint(P_WS),
+	})
+	wsMAddr = ma.StringCast("/ws")
+}
+
+// splitWS strips the trailing /ws from m, if there is one, and tells if it
+// did.
+func splitWS(m ma.Multiaddr) (ma.Multiaddr, bool) {
+	ps := m.Protocols()
+	if len(ps) == 0 || ps[len(ps)-1].Code != P_WS {
+		return m, false
+	}
+	return m.Decapsulate(wsMAddr), true
+}
+
+// wsClient performs the websocket handshake over nc, which is connected to
+// the tcp address host.
+func wsClient(ctx context.Context, nc net.Conn, host string) (net.Conn, error) {
+	defer guard(ctx, nc)()
+
+	url := "ws://" + host + "/"
+	cfg, err := websocket.NewConfig(url, url)
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := websocket.NewClient(cfg, nc)
+	if err != nil {
+		return nil, upgradeErr(ctx, err)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+
+	return newWSConn(ws, nc.LocalAddr(), nc.RemoteAddr()), nil
+}
+
+// wsListener accepts websocket connections from the http server it runs on
+// top of a tcp listener.
+type wsListener struct {
+	net.Listener
+	conns  chan net.Conn
+	closed chan bool
+}
+
+func wsListen(l net.Listener) net.Listener {
+	wl := &wsListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		closed:   make(chan bool),
+	}
+
+	srv := &http.Server{
+		Handler:           websocket.Server{Handler: wl.handle},
+		ReadHeaderTimeout: WSReadHeaderTimeout,
+		ReadTimeout:       WSReadTimeout,
+		IdleTimeout:       WSIdleTimeout,
+	}
+	go func() {
+		srv.Serve(l)
+		close(wl.closed)
+	}()
+
+	return wl
+}
+
+// handle hands ws over to Accept. The http server closes the connection
+// as soon as handle returns, so it must wait for the connection to be
+// closed by its new owner.
+func (wl *wsListener) handle(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+
+	raddr, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+	if err != nil {
+		return
+	}
+	c := newWSConn(ws, wl.Addr(), raddr)
+
+	select {
+	case wl.conns <- c:
+		<-c.done
+	case <-wl.closed:
+	}
+}
+
+func (wl *wsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-wl.conns:
+		return c, nil
+	case <-wl.closed:
+		return nil, errors.New("websocket listener is closed")
+	}
+}
+
+// wsConn reports the tcp addresses of a websocket connection instead of
+// its urls.
+type wsConn struct {
+	*websocket.Conn
+	laddr, raddr net.Addr
+
+	done chan bool
+	once sync.Once
+}
+
+func newWSConn(ws *websocket.Conn, laddr, raddr net.Addr) *wsConn {
+	return &wsConn{Conn: ws, laddr: laddr, raddr: raddr, done: make(chan bool)}
+}
+
+func (c *wsConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *wsConn) RemoteAddr() net.Addr { return c.raddr }
@@ -1,6 +1,11 @@
 package pnet
 
-import "io"
+import (
+	"context"
+	"io"
+
+	"github.com/Gaboose/go-pubsub/pnet/peerstore"
+)
 
 // Peer implementations should export all fields that need to be
 // transmitted over the network, because encoders can't see them otherwise.
@@ -17,12 +22,64 @@ type Peer interface {
 // different packages and protocols, by muxing streams with go-multistream,
 // for example.
 type ProtoNet interface {
-	Dial(Peer) (io.ReadWriteCloser, error)
+	Dialer
 	Listen() Listener
 }
 
+// Dialer is the dialing half of ProtoNet, for services that only need to
+// reach out to other nodes.
+type Dialer interface {
+	Dial(Peer) (io.ReadWriteCloser, error)
+
+	// DialContext is like Dial, but gives up as soon as ctx is done.
+	DialContext(context.Context, Peer) (io.ReadWriteCloser, error)
+}
+
 // Listener is returned by the ProtoNet interface. It's similar to net.Listener.
 type Listener interface {
 	Accept() (io.ReadWriteCloser, error)
+
+	// AcceptContext is like Accept, but returns ctx.Err() if ctx is done
+	// before a connection arrives.
+	AcceptContext(context.Context) (io.ReadWriteCloser, error)
+
 	Close() error
 }
+
+// PeerstoreProvider is implemented by ProtoNets that keep track of other
+// peers. Topo packages use it, if it's there, to record and look up what's
+// known about their neighbours.
+type PeerstoreProvider interface {
+	Peerstore() *peerstore.Peerstore
+}
+
+// ConnProtector is implemented by ProtoNets that close connections they
+// consider idle. Topo packages use it, if it's there, to keep the
+// connections they depend on.
+type ConnProtector interface {
+	Protect(p Peer, tag string)
+	Unprotect(p Peer, tag string)
+}
+
+// ProtocolStream is implemented by streams that know which protocol, or
+// which version of it, was negotiated on them.
+type ProtocolStream interface {
+	io.ReadWriteCloser
+	Protocol() string
+}
+
+// PeerStream is implemented by streams that know which peer is on the other
+// end, as authenticated by their connection, and the address the connection
+// was observed to come from.
+type PeerStream interface {
+	io.ReadWriteCloser
+	RemotePeer() interface{}
+	ObservedAddr() []byte
+}
+
+// Copier is implemented by peers that can be copied, so that the copy can be
+// Put to without changing the original. Topo packages use it, if it's there,
+// before handing their peers to others.
+type Copier interface {
+	Copy() Peer
+}
@@ -0,0 +1,448 @@
+package mock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Gaboose/go-pubsub/clock"
+	"github.com/Gaboose/go-pubsub/pnet"
+)
+
+// Link describes the connection between two peers of a Network.
+type Link struct {
+	// Latency is how long it takes bytes to reach the other end.
+	// Dialing takes twice as long.
+	Latency time.Duration
+
+	// Bandwidth is in bytes per second. Writes that go faster queue up.
+	// Zero means unlimited.
+	Bandwidth int
+
+	// Loss is the probability that a dial or a write is dropped. A dropped
+	// dial fails and a dropped write breaks the stream on both ends.
+	Loss float64
+}
+
+// ErrUnreachable is returned by dials across a partition and by streams that
+// a partition has cut.
+var ErrUnreachable = errors.New("peer is unreachable")
+
+// ErrDropped is returned by dropped dials and the streams of dropped writes.
+var ErrDropped = errors.New("dropped by the network")
+
+// Network is like ProtoNetSwarm, but its peers are connected by Links with
+// latency, limited bandwidth and losses, and it can be partitioned. Losses
+// are drawn from an RNG with a fixed seed, so that runs can be repeated.
+// Links and partitions can be changed at any time.
+type Network struct {
+	rng   *rand.Rand
+	clock clock.Clock
+	link  Link
+
+	links     map[[2]interface{}]Link
+	groups    map[interface{}]int
+	listeners map[[2]interface{}]*netListener // by protocol and peer ID
+	streams   map[*netStream]bool
+	mu        sync.Mutex
+}
+
+func NewNetwork(seed int64) *Network {
+	return NewNetworkClock(seed, clock.Real)
+}
+
+// NewNetworkClock is like NewNetwork, but the latencies and bandwidth limits
+// of its Links take the time of c.
+func NewNetworkClock(seed int64, c clock.Clock) *Network {
+	return &Network{
+		rng:       rand.New(rand.NewSource(seed)),
+		clock:     c,
+		links:     make(map[[2]interface{}]Link),
+		groups:    make(map[interface{}]int),
+		listeners: make(map[[2]interface{}]*netListener),
+		streams:   make(map[*netStream]bool),
+	}
+}
+
+// SetDefaultLink sets the Link of the peers that have none of their own.
+func (n *Network) SetDefaultLink(l Link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.link = l
+}
+
+// SetLink sets the Link between the peers a and b, both ways. Open streams
+// are affected too.
+func (n *Network) SetLink(a, b interface{}, l Link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.links[linkKey(a, b)] = l
+}
+
+// Partition splits the network into groups of peer IDs that can't reach
+// each other. Peers that aren't in any group make up another one. Streams
+// across groups are cut.
+func (n *Network) Partition(groups ...[]interface{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.groups = make(map[interface{}]int)
+	for i, g := range groups {
+		for _, id := range g {
+			n.groups[id] = i + 1
+		}
+	}
+
+	for s := range n.streams {
+		if n.groups[s.from] != n.groups[s.to] {
+			s.cut(ErrUnreachable)
+			delete(n.streams, s)
+		}
+	}
+}
+
+// Heal removes the partitions.
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+// DialListener returns the ProtoNet of proto for the peer peerid.
+func (n *Network) DialListener(peerid interface{}, proto string) pnet.ProtoNet {
+	return &netProtoNet{n, peerid, proto}
+}
+
+func linkKey(a, b interface{}) [2]interface{} {
+	if fmt.Sprint(a) > fmt.Sprint(b) {
+		a, b = b, a
+	}
+	return [2]interface{}{a, b}
+}
+
+// linkOf returns the Link between a and b. The caller must hold mu.
+func (n *Network) linkOf(a, b interface{}) Link {
+	if l, ok := n.links[linkKey(a, b)]; ok {
+		return l
+	}
+	return n.link
+}
+
+// drop draws whether something sent over l is lost. The caller must hold
+// mu.
+func (n *Network) drop(l Link) bool {
+	return l.Loss > 0 && n.rng.Float64() < l.Loss
+}
+
+type netProtoNet struct {
+	n     *Network
+	id    interface{}
+	proto string
+}
+
+func (pn *netProtoNet) Dial(p pnet.Peer) (io.ReadWriteCloser, error) {
+	return pn.DialContext(context.Background(), p)
+}
+
+func (pn *netProtoNet) DialContext(ctx context.Context, p pnet.Peer) (io.ReadWriteCloser, error) {
+	n := pn.n
+	n.mu.Lock()
+	l := n.linkOf(pn.id, p.Id())
+	reachable := n.groups[pn.id] == n.groups[p.Id()]
+	dropped := n.drop(l)
+	n.mu.Unlock()
+
+	select {
+	case <-n.clock.After(2 * l.Latency):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if !reachable {
+		return nil, ErrUnreachable
+	}
+	if dropped {
+		return nil, ErrDropped
+	}
+
+	n.mu.Lock()
+	ln, ok := n.listeners[[2]interface{}{pn.proto, p.Id()}]
+	n.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%v isn't listening", p.Id())
+	}
+
+	s := newNetStream(n, pn.id, p.Id())
+	n.mu.Lock()
+	n.streams[s] = true
+	n.mu.Unlock()
+
+	// Like a real transport, the dial doesn't wait for the stream to be
+	// accepted. Otherwise two peers that dial each other from the
+	// goroutine that also takes their accepted streams, like broadcast
+	// does, would wait for each other until the dials time out. The
+	// stream waits to be accepted until the listener closes, which fails
+	// it on both ends, or until the dialer closes it. The dial's ctx
+	// isn't waited on, since callers cancel it once the dial returns.
+	go func() {
+		select {
+		case ln.accept <- s.acceptEnd:
+		case <-ln.closed:
+			s.dialEnd.Close()
+			s.acceptEnd.Close()
+		case <-s.abandoned:
+			s.acceptEnd.Close()
+		}
+	}()
+	return s.dialEnd, nil
+}
+
+func (pn *netProtoNet) Listen() pnet.Listener {
+	n := pn.n
+	ln := &netListener{
+		n:      n,
+		key:    [2]interface{}{pn.proto, pn.id},
+		accept: make(chan io.ReadWriteCloser),
+		closed: make(chan bool),
+	}
+	n.mu.Lock()
+	n.listeners[ln.key] = ln
+	n.mu.Unlock()
+	return ln
+}
+
+type netListener struct {
+	n      *Network
+	key    [2]interface{}
+	accept chan io.ReadWriteCloser
+	closed chan bool
+	once   sync.Once
+}
+
+func (ln *netListener) Accept() (io.ReadWriteCloser, error) {
+	return ln.AcceptContext(context.Background())
+}
+
+func (ln *netListener) AcceptContext(ctx context.Context) (io.ReadWriteCloser, error) {
+	select {
+	case s := <-ln.accept:
+		return s, nil
+	case <-ln.closed:
+		return nil, errors.New("listener is closed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (ln *netListener) Close() error {
+	ln.once.Do(func() {
+		ln.n.mu.Lock()
+		if ln.n.listeners[ln.key] == ln {
+			delete(ln.n.listeners, ln.key)
+		}
+		ln.n.mu.Unlock()
+		close(ln.closed)
+	})
+	return nil
+}
+
+// netStream is a stream between the peers from and to, made of a pipe in
+// each direction.
+type netStream struct {
+	n         *Network
+	from, to  interface{}
+	dialEnd   *streamEnd
+	acceptEnd *streamEnd
+	abandoned chan struct{} // closed once the dial end is closed or cut
+	once      sync.Once
+}
+
+func newNetStream(n *Network, from, to interface{}) *netStream {
+	s := &netStream{n: n, from: from, to: to, abandoned: make(chan struct{})}
+	up, down := newPipe(n.clock), newPipe(n.clock)
+	s.dialEnd = &streamEnd{s, down, up}
+	s.acceptEnd = &streamEnd{s, up, down}
+	return s
+}
+
+// cut fails both ends of s with err.
+func (s *netStream) cut(err error) {
+	s.dialEnd.in.fail(err)
+	s.dialEnd.out.fail(err)
+	s.abandon()
+}
+
+// abandon stops the stream from waiting to be accepted.
+func (s *netStream) abandon() {
+	s.once.Do(func() { close(s.abandoned) })
+}
+
+// forget stops tracking s once both of its ends are closed.
+func (s *netStream) forget() {
+	if s.dialEnd.out.isClosed() && s.acceptEnd.out.isClosed() {
+		s.n.mu.Lock()
+		delete(s.n.streams, s)
+		s.n.mu.Unlock()
+	}
+}
+
+type streamEnd struct {
+	s   *netStream
+	in  *pipe
+	out *pipe
+}
+
+func (e *streamEnd) Read(p []byte) (int, error) {
+	return e.in.read(p)
+}
+
+func (e *streamEnd) Write(p []byte) (int, error) {
+	n := e.s.n
+	n.mu.Lock()
+	l := n.linkOf(e.s.from, e.s.to)
+	dropped := n.drop(l)
+	n.mu.Unlock()
+
+	if dropped {
+		e.s.cut(ErrDropped)
+		return 0, ErrDropped
+	}
+	return e.out.write(p, l)
+}
+
+// Close lets the other end read what's been written so far, followed by
+// io.EOF.
+func (e *streamEnd) Close() error {
+	e.out.close()
+	e.in.fail(io.ErrClosedPipe)
+	if e == e.s.dialEnd {
+		e.s.abandon()
+	}
+	e.s.forget()
+	return nil
+}
+
+type chunk struct {
+	data []byte
+	at   time.Time // when it reaches the reader
+}
+
+// pipe delivers the chunks written to it once their time comes.
+type pipe struct {
+	queue  []chunk
+	buf    []byte
+	busy   time.Time // until when the link is busy sending
+	closed bool
+	err    error
+	wake   chan struct{}
+	clock  clock.Clock
+	mu     sync.Mutex
+}
+
+func newPipe(c clock.Clock) *pipe {
+	return &pipe{wake: make(chan struct{}), clock: c}
+}
+
+// notify wakes up the reader. The caller must hold mu.
+func (p *pipe) notify() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+func (p *pipe) write(b []byte, l Link) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return 0, p.err
+	}
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	now := p.clock.Now()
+	start := p.busy
+	if start.Before(now) {
+		start = now
+	}
+	p.busy = start
+	if l.Bandwidth > 0 {
+		p.busy = start.Add(time.Duration(len(b)) * time.Second / time.Duration(l.Bandwidth))
+	}
+
+	data := append([]byte(nil), b...)
+	p.queue = append(p.queue, chunk{data, p.busy.Add(l.Latency)})
+	p.notify()
+	return len(b), nil
+}
+
+func (p *pipe) read(b []byte) (int, error) {
+	p.mu.Lock()
+	for {
+		if p.err != nil {
+			err := p.err
+			p.mu.Unlock()
+			return 0, err
+		}
+
+		now := p.clock.Now()
+		for len(p.queue) > 0 && !p.queue[0].at.After(now) {
+			p.buf = append(p.buf, p.queue[0].data...)
+			p.queue = p.queue[1:]
+		}
+		if len(p.buf) > 0 {
+			n := copy(b, p.buf)
+			p.buf = p.buf[n:]
+			p.mu.Unlock()
+			return n, nil
+		}
+		if p.closed && len(p.queue) == 0 {
+			p.mu.Unlock()
+			return 0, io.EOF
+		}
+
+		var t *clock.Timer
+		var due <-chan time.Time
+		if len(p.queue) > 0 {
+			t = p.clock.NewTimer(p.queue[0].at.Sub(now))
+			due = t.C
+		}
+		wake := p.wake
+		p.mu.Unlock()
+
+		select {
+		case <-due:
+		case <-wake:
+		}
+		if t != nil {
+			t.Stop()
+		}
+		p.mu.Lock()
+	}
+}
+
+// close makes the reader get io.EOF once it's read everything.
+func (p *pipe) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.notify()
+}
+
+func (p *pipe) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed || p.err != nil
+}
+
+// fail makes both the reader and the writer get err from now on, unless
+// they already get another one.
+func (p *pipe) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+		p.notify()
+	}
+}
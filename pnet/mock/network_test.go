@@ -0,0 +1,233 @@
+package mock
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/go-pubsub/clock"
+)
+
+func TestLatency(t *testing.T) {
+	n := NewNetwork(1)
+	n.SetDefaultLink(Link{Latency: 20 * time.Millisecond})
+
+	ln := n.DialListener("p0", "/foo").Listen()
+	defer ln.Close()
+	go func() {
+		s, err := ln.Accept()
+		if err == nil {
+			io.Copy(s, s)
+			s.Close()
+		}
+	}()
+
+	start := time.Now()
+	s, err := n.DialListener("p1", "/foo").Dial(&Peer{ID: "p0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(s, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A dial and an echo are two round trips
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Fatalf("expected at least 80ms, took %v", d)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	n := NewNetwork(1)
+
+	ln := n.DialListener("p0", "/foo").Listen()
+	defer ln.Close()
+	accepted := make(chan io.ReadWriteCloser, 1)
+	go func() {
+		for {
+			s, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- s
+		}
+	}()
+
+	pn := n.DialListener("p1", "/foo")
+	s, err := pn.Dial(&Peer{ID: "p0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s0 := <-accepted
+
+	// The open stream is cut, and no new ones can be made
+	n.Partition([]interface{}{"p0"})
+	_, err = s0.Read(make([]byte, 1))
+	if err != ErrUnreachable {
+		t.Fatalf("expected ErrUnreachable reading, got %v", err)
+	}
+	_, err = s.Write([]byte("hello"))
+	if err != ErrUnreachable {
+		t.Fatalf("expected ErrUnreachable writing, got %v", err)
+	}
+	_, err = pn.Dial(&Peer{ID: "p0"})
+	if err != ErrUnreachable {
+		t.Fatalf("expected ErrUnreachable dialing, got %v", err)
+	}
+
+	n.Heal()
+	s, err = pn.Dial(&Peer{ID: "p0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+func TestLoss(t *testing.T) {
+	// The same seed drops the same dials
+	dials := func() []bool {
+		n := NewNetwork(42)
+		n.SetLink("p0", "p1", Link{Loss: 0.5})
+		ln := n.DialListener("p0", "/foo").Listen()
+		defer ln.Close()
+		go func() {
+			for {
+				s, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				s.Close()
+			}
+		}()
+
+		pn := n.DialListener("p1", "/foo")
+		var ok []bool
+		for i := 0; i < 20; i++ {
+			s, err := pn.Dial(&Peer{ID: "p0"})
+			if err == nil {
+				s.Close()
+			} else if err != ErrDropped {
+				t.Fatal(err)
+			}
+			ok = append(ok, err == nil)
+		}
+		return ok
+	}
+
+	a, b := dials(), dials()
+	dropped := 0
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("expected the same dials to be dropped, got %v and %v", a, b)
+		}
+		if !a[i] {
+			dropped++
+		}
+	}
+	if dropped == 0 || dropped == len(a) {
+		t.Fatalf("expected some of the dials to be dropped, got %v", a)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	n := NewNetwork(1)
+	n.SetDefaultLink(Link{Bandwidth: 1000})
+
+	ln := n.DialListener("p0", "/foo").Listen()
+	defer ln.Close()
+	go func() {
+		s, err := ln.Accept()
+		if err == nil {
+			s.Write(make([]byte, 100))
+			s.Close()
+		}
+	}()
+
+	s, err := n.DialListener("p1", "/foo").Dial(&Peer{ID: "p0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = io.ReadFull(s, make([]byte, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 100 bytes at 1000 B/s take 100ms
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Fatalf("expected about 100ms, took %v", d)
+	}
+}
+
+func TestUnaccepted(t *testing.T) {
+	n := NewNetwork(1)
+	ln := n.DialListener("p0", "/foo").Listen()
+
+	// The dial returns before the stream is accepted
+	s, err := n.DialListener("p1", "/foo").Dial(&Peer{ID: "p0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// and fails once the listener closes without accepting it
+	ln.Close()
+	_, err = s.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("expected the stream to fail")
+	}
+	_, err = s.Write([]byte("hello"))
+	if err == nil {
+		t.Fatal("expected writing to fail")
+	}
+}
+
+func TestNetworkClock(t *testing.T) {
+	c := clock.NewFake(time.Unix(0, 0))
+	n := NewNetworkClock(1, c)
+	n.SetDefaultLink(Link{Latency: time.Hour})
+
+	ln := n.DialListener("p0", "/foo").Listen()
+	defer ln.Close()
+	accepted := make(chan io.ReadWriteCloser, 1)
+	go func() {
+		s, err := ln.Accept()
+		if err == nil {
+			accepted <- s
+		}
+	}()
+
+	// Dialing takes two hours on the clock
+	dialed := make(chan io.ReadWriteCloser, 1)
+	go func() {
+		s, err := n.DialListener("p1", "/foo").Dial(&Peer{ID: "p0"})
+		if err != nil {
+			t.Error(err)
+		}
+		dialed <- s
+	}()
+	c.BlockUntil(1)
+	c.Advance(2 * time.Hour)
+	s := <-dialed
+	defer s.Close()
+	s0 := <-accepted
+	defer s0.Close()
+
+	// And a write takes an hour to arrive
+	s.Write([]byte("hello"))
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(s0, make([]byte, 5))
+		read <- err
+	}()
+	c.BlockUntil(1)
+	c.Advance(time.Hour)
+	err := <-read
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,6 +1,10 @@
 package mock
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/Gaboose/go-pubsub/pnet"
+)
 
 type Peer struct {
 	ID     string
@@ -9,6 +13,17 @@ type Peer struct {
 
 func (p Peer) Id() interface{}          { return p.ID }
 func (p Peer) Get(k string) interface{} { return p.Params[k] }
+
+// Copy returns a copy of p with a map of params of its own.
+func (p *Peer) Copy() pnet.Peer {
+	cp := *p
+	cp.Params = make(map[string]interface{}, len(p.Params))
+	for k, v := range p.Params {
+		cp.Params[k] = v
+	}
+	return &cp
+}
+
 func (p *Peer) Put(k string, v interface{}) {
 	if p.Params == nil {
 		p.Params = make(map[string]interface{})
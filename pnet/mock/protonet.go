@@ -1,60 +1,391 @@
 package mock
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"github.com/Gaboose/go-pubsub/pnet"
 	"io"
+	"math/rand"
 	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Gaboose/go-pubsub/clock"
+	"github.com/Gaboose/go-pubsub/pnet"
 )
 
-type ProtoNetSwarm map[interface{}]*listener
+// Failure is how a peer of a ProtoNetSwarm fails.
+type Failure int
+
+const (
+	// Up is a peer that works.
+	Up Failure = iota
+
+	// Crash makes the listeners of a peer vanish and closes its open
+	// connections. It can't dial either.
+	Crash
+
+	// Freeze leaves the connections of a peer open, but no data moves
+	// over them, like the OpenShift limbo described in svice/ping. New
+	// connections are accepted and freeze too.
+	Freeze
+
+	// Slow delays dials and writes to and from a peer by
+	// ProtoNetSwarm.Latency.
+	Slow
+)
+
+func (f Failure) String() string {
+	switch f {
+	case Up:
+		return "up"
+	case Crash:
+		return "crash"
+	case Freeze:
+		return "freeze"
+	case Slow:
+		return "slow"
+	}
+	return fmt.Sprintf("Failure(%d)", int(f))
+}
 
-func (sw ProtoNetSwarm) DialListener(peerid interface{}) *ProtoNet {
+// ProtoNetSwarm connects the ProtoNets it hands out with pipes. Its zero
+// value is ready to use, and its peers can be made to fail.
+type ProtoNetSwarm struct {
+	// Latency of the slow peers. A second if it's 0.
+	Latency time.Duration
+
+	// Clock times the latency and the schedules. clock.Real if it's nil.
+	Clock clock.Clock
+
+	lns    map[interface{}]*listener
+	state  map[interface{}]Failure
+	conns  map[*conn]bool
+	change chan struct{} // closed and replaced when a peer changes state
+	mu     sync.Mutex
+}
+
+func (sw *ProtoNetSwarm) DialListener(peerid interface{}) *ProtoNet {
 	return &ProtoNet{sw, peerid}
 }
 
+// init makes the maps of a zero value. The caller must hold mu.
+func (sw *ProtoNetSwarm) init() {
+	if sw.lns == nil {
+		sw.lns = make(map[interface{}]*listener)
+		sw.state = make(map[interface{}]Failure)
+		sw.conns = make(map[*conn]bool)
+		sw.change = make(chan struct{})
+	}
+}
+
+func (sw *ProtoNetSwarm) clock() clock.Clock {
+	if sw.Clock == nil {
+		return clock.Real
+	}
+	return sw.Clock
+}
+
+func (sw *ProtoNetSwarm) latency() time.Duration {
+	if sw.Latency == 0 {
+		return time.Second
+	}
+	return sw.Latency
+}
+
+// Kill makes the peer fail in the given way until it's revived. Killing it
+// with Up revives it.
+func (sw *ProtoNetSwarm) Kill(peerid interface{}, f Failure) {
+	sw.mu.Lock()
+	sw.init()
+	if f == Up {
+		delete(sw.state, peerid)
+	} else {
+		sw.state[peerid] = f
+	}
+	var closing []*conn
+	if f == Crash {
+		for c := range sw.conns {
+			if c.local == peerid || c.remote == peerid {
+				closing = append(closing, c)
+			}
+		}
+	}
+	close(sw.change)
+	sw.change = make(chan struct{})
+	sw.mu.Unlock()
+
+	for _, c := range closing {
+		c.Close()
+	}
+}
+
+// Revive makes the peer work again. Its listeners are back, but the
+// connections that a crash closed aren't.
+func (sw *ProtoNetSwarm) Revive(peerid interface{}) {
+	sw.Kill(peerid, Up)
+}
+
+// State returns how the peer currently fails, or Up.
+func (sw *ProtoNetSwarm) State(peerid interface{}) Failure {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.state[peerid]
+}
+
+// Event is a change of state of a peer, At a time after its schedule
+// starts.
+type Event struct {
+	At      time.Duration
+	Peer    interface{}
+	Failure Failure
+}
+
+// Schedule applies the events in the background, each at its time.
+// Closing the returned channel cancels the events still to come.
+func (sw *ProtoNetSwarm) Schedule(events []Event) chan bool {
+	stop := make(chan bool)
+	c := sw.clock()
+	start := c.Now()
+	go func() {
+		for _, e := range events {
+			t := c.NewTimer(start.Add(e.At).Sub(c.Now()))
+			select {
+			case <-t.C:
+				sw.Kill(e.Peer, e.Failure)
+			case <-stop:
+				t.Stop()
+				return
+			}
+		}
+	}()
+	return stop
+}
+
+// Churn kills a listening peer picked with rng every interval, in the
+// given way, and revives it after downtime. Closing the returned channel
+// stops the killing, but the peers already killed are still revived.
+func (sw *ProtoNetSwarm) Churn(rng *rand.Rand, interval, downtime time.Duration, f Failure) chan bool {
+	stop := make(chan bool)
+	c := sw.clock()
+	go func() {
+		tk := c.NewTicker(interval)
+		defer tk.Stop()
+		for {
+			select {
+			case <-tk.C:
+			case <-stop:
+				return
+			}
+
+			id, ok := sw.pickUp(rng)
+			if !ok {
+				continue
+			}
+			sw.Kill(id, f)
+			go func() {
+				<-c.After(downtime)
+				sw.Revive(id)
+			}()
+		}
+	}()
+	return stop
+}
+
+// pickUp picks a listening peer that works.
+func (sw *ProtoNetSwarm) pickUp(rng *rand.Rand) (interface{}, bool) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	var ids []interface{}
+	for id := range sw.lns {
+		if sw.state[id] == Up {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, false
+	}
+
+	// Sorted first, so that the same rng picks the same peers
+	sort.Slice(ids, func(i, j int) bool {
+		return fmt.Sprint(ids[i]) < fmt.Sprint(ids[j])
+	})
+	return ids[rng.Intn(len(ids))], true
+}
+
+// delay waits while either peer is frozen, and then for the latency if
+// either is slow. It returns an error if done is closed first.
+func (sw *ProtoNetSwarm) delay(a, b interface{}, done <-chan struct{}) error {
+	for {
+		sw.mu.Lock()
+		sw.init()
+		frozen := sw.state[a] == Freeze || sw.state[b] == Freeze
+		change := sw.change
+		sw.mu.Unlock()
+
+		if !frozen {
+			return sw.slow(a, b, done)
+		}
+		select {
+		case <-change:
+		case <-done:
+			return io.ErrClosedPipe
+		}
+	}
+}
+
+// slow waits for the latency if either peer is slow. It returns an error
+// if done is closed first.
+func (sw *ProtoNetSwarm) slow(a, b interface{}, done <-chan struct{}) error {
+	if sw.State(a) != Slow && sw.State(b) != Slow {
+		return nil
+	}
+	select {
+	case <-sw.clock().After(sw.latency()):
+		return nil
+	case <-done:
+		return io.ErrClosedPipe
+	}
+}
+
 type ProtoNet struct {
-	sw ProtoNetSwarm
+	sw *ProtoNetSwarm
 	id interface{}
 }
 
 func (pn *ProtoNet) Dial(p pnet.Peer) (io.ReadWriteCloser, error) {
-	ln, ok := pn.sw[p.Id()]
-	if !ok {
+	return pn.DialContext(context.Background(), p)
+}
+
+func (pn *ProtoNet) DialContext(ctx context.Context, p pnet.Peer) (io.ReadWriteCloser, error) {
+	sw := pn.sw
+	sw.mu.Lock()
+	sw.init()
+	if sw.state[pn.id] == Crash {
+		sw.mu.Unlock()
+		return nil, fmt.Errorf("%s is down", pn.id)
+	}
+	ln, ok := sw.lns[p.Id()]
+	if !ok || sw.state[p.Id()] == Crash {
+		sw.mu.Unlock()
 		msg := fmt.Sprintf("%s isn't listening", p.Id())
 		return nil, errors.New(msg)
 	}
+	sw.mu.Unlock()
+
+	// Frozen peers still accept, it's the data that doesn't move
+	err := sw.slow(pn.id, p.Id(), ctx.Done())
+	if err != nil {
+		return nil, ctx.Err()
+	}
+
 	conn1, conn2 := net.Pipe()
-	ln.accept <- conn1
-	return conn2, nil
+	c1 := sw.newConn(conn1, p.Id(), pn.id)
+	c2 := sw.newConn(conn2, pn.id, p.Id())
+	select {
+	case ln.accept <- c1:
+		return c2, nil
+	case <-ln.closed:
+		c1.Close()
+		c2.Close()
+		msg := fmt.Sprintf("%s isn't listening", p.Id())
+		return nil, errors.New(msg)
+	case <-ctx.Done():
+		c1.Close()
+		c2.Close()
+		return nil, ctx.Err()
+	}
 }
 
 func (pn *ProtoNet) Listen() pnet.Listener {
-	accept := make(chan io.ReadWriteCloser)
-	closeFn := func() error {
-		close(accept)
-		delete(pn.sw, pn.id)
-		return nil
+	sw := pn.sw
+	ln := &listener{
+		accept: make(chan io.ReadWriteCloser),
+		closed: make(chan bool),
 	}
-	ln := &listener{accept, closeFn}
-	pn.sw[pn.id] = ln
+	ln.close = func() {
+		sw.mu.Lock()
+		if sw.lns[pn.id] == ln {
+			delete(sw.lns, pn.id)
+		}
+		sw.mu.Unlock()
+		close(ln.closed)
+	}
+
+	sw.mu.Lock()
+	sw.init()
+	sw.lns[pn.id] = ln
+	sw.mu.Unlock()
 	return ln
 }
 
 type listener struct {
 	accept chan io.ReadWriteCloser
-	close  func() error
+	closed chan bool
+	close  func()
+	once   sync.Once
 }
 
 func (ln *listener) Accept() (io.ReadWriteCloser, error) {
-	s, ok := <-ln.accept
-	if !ok {
-		return nil, errors.New("accept channel is closed")
+	return ln.AcceptContext(context.Background())
+}
+
+func (ln *listener) AcceptContext(ctx context.Context) (io.ReadWriteCloser, error) {
+	select {
+	case s := <-ln.accept:
+		return s, nil
+	case <-ln.closed:
+		return nil, errors.New("listener is closed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	return s, nil
 }
 
 func (ln *listener) Close() error {
-	return ln.close()
+	ln.once.Do(ln.close)
+	return nil
+}
+
+// conn is one end of a pipe between the peers local and remote. Writes
+// wait while either is frozen, and the pipe makes the reads wait for them.
+type conn struct {
+	net.Conn
+	sw            *ProtoNetSwarm
+	local, remote interface{}
+	done          chan struct{}
+	once          sync.Once
+}
+
+func (sw *ProtoNetSwarm) newConn(c net.Conn, local, remote interface{}) *conn {
+	cn := &conn{Conn: c, sw: sw, local: local, remote: remote, done: make(chan struct{})}
+	sw.mu.Lock()
+	sw.conns[cn] = true
+	sw.mu.Unlock()
+	return cn
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	if err := c.sw.delay(c.local, c.remote, c.done); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+// RemotePeer returns the id of the peer on the other end.
+func (c *conn) RemotePeer() interface{} { return c.remote }
+
+// ObservedAddr returns the id of the peer on the other end, which is where
+// mock peers are observed at.
+func (c *conn) ObservedAddr() []byte { return []byte(fmt.Sprint(c.remote)) }
+
+func (c *conn) Close() error {
+	c.once.Do(func() {
+		c.sw.mu.Lock()
+		delete(c.sw.conns, c)
+		c.sw.mu.Unlock()
+		close(c.done)
+	})
+	return c.Conn.Close()
 }
@@ -0,0 +1,201 @@
+package mock
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/go-pubsub/clock"
+	"github.com/Gaboose/go-pubsub/pnet"
+)
+
+// echo accepts streams on ln and writes back what they read.
+func echo(ln pnet.Listener) {
+	for {
+		s, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(s, s)
+			s.Close()
+		}()
+	}
+}
+
+func TestCrash(t *testing.T) {
+	sw := ProtoNetSwarm{}
+	ln := sw.DialListener("p0").Listen()
+	defer ln.Close()
+	go echo(ln)
+
+	pn := sw.DialListener("p1")
+	s, err := pn.Dial(&Peer{ID: "p0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The open stream is closed, and no new ones can be made
+	sw.Kill("p0", Crash)
+	_, err = s.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("expected the stream to be closed")
+	}
+	_, err = pn.Dial(&Peer{ID: "p0"})
+	if err == nil {
+		t.Fatal("expected dialing to fail")
+	}
+	_, err = sw.DialListener("p0").Dial(&Peer{ID: "p1"})
+	if err == nil {
+		t.Fatal("expected dialing from a crashed peer to fail")
+	}
+
+	// Once revived, its listener is back
+	sw.Revive("p0")
+	s, err = pn.Dial(&Peer{ID: "p0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+func TestFreeze(t *testing.T) {
+	sw := ProtoNetSwarm{}
+	ln := sw.DialListener("p0").Listen()
+	defer ln.Close()
+	go echo(ln)
+
+	sw.Kill("p0", Freeze)
+
+	// Dialing goes through, but nothing comes back
+	s, err := sw.DialListener("p1").Dial(&Peer{ID: "p0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	read := make(chan error, 1)
+	go func() {
+		s.Write([]byte("hello"))
+		_, err := io.ReadFull(s, make([]byte, 5))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		t.Fatalf("expected the stream to hang, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	sw.Revive("p0")
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestSlow(t *testing.T) {
+	c := clock.NewFake(time.Unix(0, 0))
+	sw := ProtoNetSwarm{Latency: time.Hour, Clock: c}
+	ln := sw.DialListener("p0").Listen()
+	defer ln.Close()
+	go func() {
+		s, err := ln.Accept()
+		if err == nil {
+			io.Copy(ioutil.Discard, s)
+		}
+	}()
+
+	sw.Kill("p1", Slow)
+
+	// Dialing and writing take an hour each on the clock
+	done := make(chan error, 1)
+	go func() {
+		s, err := sw.DialListener("p1").Dial(&Peer{ID: "p0"})
+		if err == nil {
+			_, err = s.Write([]byte("hello"))
+			s.Close()
+		}
+		done <- err
+	}()
+	for i := 0; i < 2; i++ {
+		c.BlockUntil(1)
+		c.Advance(time.Hour)
+	}
+	err := <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	c := clock.NewFake(time.Unix(0, 0))
+	sw := ProtoNetSwarm{Clock: c}
+
+	stop := sw.Schedule([]Event{
+		{At: time.Minute, Peer: "p0", Failure: Crash},
+		{At: 2 * time.Minute, Peer: "p0", Failure: Up},
+		{At: 3 * time.Minute, Peer: "p0", Failure: Freeze},
+	})
+	defer close(stop)
+
+	for i, f := range []Failure{Crash, Up} {
+		c.BlockUntil(1)
+		c.Advance(time.Minute)
+
+		// Kill runs in the background just after the timer fires
+		for j := 0; j < 100 && sw.State("p0") != f; j++ {
+			time.Sleep(time.Millisecond)
+		}
+		if sw.State("p0") != f {
+			t.Fatalf("expected p0 to be %v after %d minutes, got %v", f, i+1, sw.State("p0"))
+		}
+	}
+}
+
+func TestChurn(t *testing.T) {
+	c := clock.NewFake(time.Unix(0, 0))
+	sw := ProtoNetSwarm{Clock: c}
+	for _, id := range []string{"p0", "p1", "p2"} {
+		ln := sw.DialListener(id).Listen()
+		defer ln.Close()
+	}
+
+	stop := sw.Churn(rand.New(rand.NewSource(1)), time.Minute, time.Hour, Crash)
+	c.BlockUntil(1)
+	c.Advance(time.Minute)
+
+	// One of the peers crashes, and is revived an hour later
+	down := func() int {
+		n := 0
+		for _, id := range []string{"p0", "p1", "p2"} {
+			if sw.State(id) == Crash {
+				n++
+			}
+		}
+		return n
+	}
+	for i := 0; i < 100 && down() != 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if down() != 1 {
+		t.Fatalf("expected a peer to crash, %d did", down())
+	}
+
+	// Once the ticker is stopped, the revival is the only one waiting
+	close(stop)
+	for i := 0; i < 100 && c.Waiters() != 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Advance(time.Hour)
+	for i := 0; i < 100 && down() != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if down() != 0 {
+		t.Fatalf("expected the peer to be revived, %d are down", down())
+	}
+}
@@ -0,0 +1,244 @@
+package peerstore
+
+import (
+	"sync"
+	"time"
+)
+
+// Common lifetimes of addresses
+const (
+	// TempAddrTTL is for addresses heard from third parties, e.g. through
+	// Cyclon gossip, that may well be stale.
+	TempAddrTTL = 10 * time.Minute
+
+	// ConnectedAddrTTL is for addresses that we were connected through or
+	// that a connected peer told us about itself.
+	ConnectedAddrTTL = time.Hour
+
+	// PermanentAddrTTL is for addresses that never expire, e.g. those of
+	// bootstrap peers.
+	PermanentAddrTTL = time.Duration(1<<63 - 1)
+)
+
+// LatencyEWMASmoothing is the weight of a new latency sample in the moving
+// average.
+var LatencyEWMASmoothing = 0.1
+
+// Peerstore keeps what is known about other peers by their IDs: addresses
+// that expire, observed latency, supported protocols and arbitrary metadata.
+// It's safe for concurrent use.
+type Peerstore struct {
+	peers map[string]*peer
+	mu    sync.RWMutex
+
+	now func() time.Time
+}
+
+type peer struct {
+	addrs   map[string]time.Time // address bytes to expiry
+	latency time.Duration
+	protos  []string
+	meta    map[string]interface{}
+}
+
+func New() *Peerstore {
+	return &Peerstore{
+		peers: make(map[string]*peer),
+		now:   time.Now,
+	}
+}
+
+// peer returns the entry of id, creating it if needed. The caller must hold
+// the write lock.
+func (ps *Peerstore) peer(id string) *peer {
+	p, ok := ps.peers[id]
+	if !ok {
+		p = &peer{
+			addrs: make(map[string]time.Time),
+			meta:  make(map[string]interface{}),
+		}
+		ps.peers[id] = p
+	}
+	return p
+}
+
+// Peers returns the IDs of all known peers.
+func (ps *Peerstore) Peers() []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	ids := make([]string, 0, len(ps.peers))
+	for id := range ps.peers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// AddAddrs adds addrs to the known addresses of id for the duration of ttl.
+// Addresses known already have their expiry extended, but never shortened.
+func (ps *Peerstore) AddAddrs(id string, addrs [][]byte, ttl time.Duration) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	exp := ps.expiry(ttl)
+	p := ps.peer(id)
+	for _, a := range addrs {
+		if old, ok := p.addrs[string(a)]; !ok || old.Before(exp) {
+			p.addrs[string(a)] = exp
+		}
+	}
+}
+
+// SetAddrs is like AddAddrs, but shortens the expiry of addresses known
+// already too. A ttl of 0 removes them.
+func (ps *Peerstore) SetAddrs(id string, addrs [][]byte, ttl time.Duration) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	exp := ps.expiry(ttl)
+	p := ps.peer(id)
+	for _, a := range addrs {
+		if ttl <= 0 {
+			delete(p.addrs, string(a))
+		} else {
+			p.addrs[string(a)] = exp
+		}
+	}
+}
+
+func (ps *Peerstore) expiry(ttl time.Duration) time.Time {
+	now := ps.now()
+	if ttl > PermanentAddrTTL-time.Duration(now.UnixNano()) {
+		return time.Unix(0, int64(PermanentAddrTTL))
+	}
+	return now.Add(ttl)
+}
+
+// Addrs returns the addresses of id that haven't expired yet. The expired
+// ones are forgotten.
+func (ps *Peerstore) Addrs(id string) [][]byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	p, ok := ps.peers[id]
+	if !ok {
+		return nil
+	}
+
+	now := ps.now()
+	var addrs [][]byte
+	for a, exp := range p.addrs {
+		if now.After(exp) {
+			delete(p.addrs, a)
+			continue
+		}
+		addrs = append(addrs, []byte(a))
+	}
+	return addrs
+}
+
+// RecordLatency adds a round trip time sample to the moving average of id.
+func (ps *Peerstore) RecordLatency(id string, d time.Duration) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	p := ps.peer(id)
+	if p.latency == 0 {
+		p.latency = d
+		return
+	}
+	s := LatencyEWMASmoothing
+	p.latency = time.Duration(s*float64(d) + (1-s)*float64(p.latency))
+}
+
+// Latency returns the moving average of round trip times to id, or 0 if
+// there are no samples.
+func (ps *Peerstore) Latency(id string) time.Duration {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	p, ok := ps.peers[id]
+	if !ok {
+		return 0
+	}
+	return p.latency
+}
+
+// SetProtocols replaces the protocols id is known to support.
+func (ps *Peerstore) SetProtocols(id string, protos []string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.peer(id).protos = append([]string(nil), protos...)
+}
+
+// Protocols returns the protocols id is known to support.
+func (ps *Peerstore) Protocols(id string) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	p, ok := ps.peers[id]
+	if !ok {
+		return nil
+	}
+	return append([]string(nil), p.protos...)
+}
+
+// Supports tells if id is known to support proto. It's false if its
+// protocols aren't known at all.
+func (ps *Peerstore) Supports(id, proto string) bool {
+	for _, p := range ps.Protocols(id) {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// Put stores arbitrary metadata about id under key.
+func (ps *Peerstore) Put(id, key string, val interface{}) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.peer(id).meta[key] = val
+}
+
+// Get returns the metadata stored about id under key, or nil.
+func (ps *Peerstore) Get(id, key string) interface{} {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	p, ok := ps.peers[id]
+	if !ok {
+		return nil
+	}
+	return p.meta[key]
+}
+
+// GC forgets everything about the peers that have no addresses left that
+// haven't expired, unless keep tells to keep them, e.g. because they're
+// connected. It returns the IDs of the peers it forgot.
+func (ps *Peerstore) GC(keep func(id string) bool) []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	now := ps.now()
+	var removed []string
+	for id, p := range ps.peers {
+		for a, exp := range p.addrs {
+			if now.After(exp) {
+				delete(p.addrs, a)
+			}
+		}
+		if len(p.addrs) == 0 && !keep(id) {
+			delete(ps.peers, id)
+			removed = append(removed, id)
+		}
+	}
+	return removed
+}
+
+// Remove forgets everything about id.
+func (ps *Peerstore) Remove(id string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(ps.peers, id)
+}
@@ -0,0 +1,99 @@
+package peerstore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddAddrs(t *testing.T) {
+	ps := New()
+	ps.AddAddrs("peer0", [][]byte{[]byte("a"), []byte("b")}, TempAddrTTL)
+	ps.AddAddrs("peer0", [][]byte{[]byte("b"), []byte("c")}, TempAddrTTL)
+
+	addrs := ps.Addrs("peer0")
+	if len(addrs) != 3 {
+		t.Fatalf("expected 3 addresses, got %q", addrs)
+	}
+	if ps.Addrs("peer1") != nil {
+		t.Fatal("expected no addresses of an unknown peer")
+	}
+}
+
+func TestAddrTTL(t *testing.T) {
+	now := time.Unix(0, 0)
+	ps := New()
+	ps.now = func() time.Time { return now }
+
+	ps.AddAddrs("peer0", [][]byte{[]byte("a")}, time.Minute)
+	ps.AddAddrs("peer0", [][]byte{[]byte("b")}, time.Hour)
+	ps.AddAddrs("peer0", [][]byte{[]byte("c")}, PermanentAddrTTL)
+
+	// A shorter ttl doesn't shorten the expiry with AddAddrs
+	ps.AddAddrs("peer0", [][]byte{[]byte("b")}, time.Minute)
+
+	now = now.Add(2 * time.Minute)
+	if addrs := ps.Addrs("peer0"); len(addrs) != 2 {
+		t.Fatalf("expected 2 addresses, got %q", addrs)
+	}
+
+	ps.SetAddrs("peer0", [][]byte{[]byte("b")}, 0)
+	addrs := ps.Addrs("peer0")
+	if len(addrs) != 1 || string(addrs[0]) != "c" {
+		t.Fatalf("expected [c], got %q", addrs)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	ps := New()
+	if ps.Latency("peer0") != 0 {
+		t.Fatal("expected no latency of an unknown peer")
+	}
+
+	ps.RecordLatency("peer0", 100*time.Millisecond)
+	if l := ps.Latency("peer0"); l != 100*time.Millisecond {
+		t.Fatalf("expected the first sample, got %v", l)
+	}
+
+	ps.RecordLatency("peer0", 200*time.Millisecond)
+	if l := ps.Latency("peer0"); l <= 100*time.Millisecond || l >= 200*time.Millisecond {
+		t.Fatalf("expected an average between samples, got %v", l)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	ps := New()
+	ps.Put("peer0", "foo", 1)
+
+	if v := ps.Get("peer0", "foo"); v != 1 {
+		t.Fatalf("expected 1, got %v", v)
+	}
+	if v := ps.Get("peer0", "bar"); v != nil {
+		t.Fatalf("expected nil, got %v", v)
+	}
+}
+
+func TestGC(t *testing.T) {
+	now := time.Unix(0, 0)
+	ps := New()
+	ps.now = func() time.Time { return now }
+
+	ps.AddAddrs("peer0", [][]byte{[]byte("a")}, time.Minute)
+	ps.AddAddrs("peer1", [][]byte{[]byte("b")}, time.Minute)
+	ps.AddAddrs("peer2", [][]byte{[]byte("c")}, time.Hour)
+	ps.Put("peer3", "key", "val")
+
+	// Once their addresses expire, only the peers kept are left
+	now = now.Add(2 * time.Minute)
+	removed := ps.GC(func(id string) bool { return id == "peer1" })
+	if len(removed) != 2 {
+		t.Fatalf("expected peer0 and peer3 to be forgotten, got %v", removed)
+	}
+	for _, id := range removed {
+		if id != "peer0" && id != "peer3" {
+			t.Fatalf("expected peer0 and peer3 to be forgotten, got %v", removed)
+		}
+	}
+	if len(ps.Peers()) != 2 {
+		t.Fatalf("expected 2 peers left, got %v", ps.Peers())
+	}
+}
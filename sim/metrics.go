@@ -0,0 +1,219 @@
+package sim
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Graph is the overlay that Cyclon caches form. It maps the ID of every live
+// node to the IDs in its cache. IDs that aren't keys belong to nodes that
+// are gone.
+type Graph map[string][]string
+
+// Metrics describe the shape of an overlay.
+type Metrics struct {
+	Nodes int
+
+	// InDegree counts the nodes by the number of caches they're in.
+	InDegree       map[int]int
+	InDegreeMean   float64
+	InDegreeStdDev float64
+
+	// DeadLinks is the number of cache entries of nodes that are gone.
+	DeadLinks int
+
+	// Clustering is the average clustering coefficient of the nodes, and
+	// PathLength the average length of the shortest paths between them.
+	// The links are taken as undirected for both.
+	Clustering float64
+	PathLength float64
+
+	// Partitions is the number of parts the overlay is split into.
+	Partitions int
+}
+
+// MaxPathSources bounds how many nodes the shortest paths are measured
+// from. Above that, they're sampled at random.
+var MaxPathSources = 100
+
+// Measure computes the metrics of g. Path lengths are sampled with rng.
+func Measure(g Graph, rng *rand.Rand) Metrics {
+	m := Metrics{Nodes: len(g), InDegree: make(map[int]int)}
+	if len(g) == 0 {
+		return m
+	}
+
+	in := g.InDegrees()
+	var sum, sqsum float64
+	for _, id := range g.ids() {
+		d := in[id]
+		m.InDegree[d]++
+		sum += float64(d)
+		sqsum += float64(d * d)
+	}
+	n := float64(len(g))
+	m.InDegreeMean = sum / n
+	m.InDegreeStdDev = math.Sqrt(math.Max(sqsum/n-m.InDegreeMean*m.InDegreeMean, 0))
+
+	for _, ns := range g {
+		for _, v := range ns {
+			if _, ok := g[v]; !ok {
+				m.DeadLinks++
+			}
+		}
+	}
+
+	m.Clustering = g.Clustering()
+	sources := g.ids()
+	if len(sources) > MaxPathSources {
+		rng.Shuffle(len(sources), func(i, j int) {
+			sources[i], sources[j] = sources[j], sources[i]
+		})
+		sources = sources[:MaxPathSources]
+	}
+	m.PathLength = g.PathLength(sources)
+	m.Partitions = g.Partitions()
+	return m
+}
+
+// ids returns the live nodes in order, so that results don't depend on map
+// iteration.
+func (g Graph) ids() []string {
+	ids := make([]string, 0, len(g))
+	for id := range g {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// InDegrees returns the number of caches every live node is in.
+func (g Graph) InDegrees() map[string]int {
+	in := make(map[string]int, len(g))
+	for id := range g {
+		in[id] = 0
+	}
+	for _, ns := range g {
+		for _, v := range ns {
+			if _, ok := g[v]; ok {
+				in[v]++
+			}
+		}
+	}
+	return in
+}
+
+// undirected returns the neighbours of every node with the links taken both
+// ways. Links to nodes that are gone are left out.
+func (g Graph) undirected() map[string]map[string]bool {
+	u := make(map[string]map[string]bool, len(g))
+	for id := range g {
+		u[id] = make(map[string]bool)
+	}
+	for id, ns := range g {
+		for _, v := range ns {
+			if _, ok := g[v]; ok && v != id {
+				u[id][v] = true
+				u[v][id] = true
+			}
+		}
+	}
+	return u
+}
+
+// Clustering returns the average clustering coefficient: how many of the
+// links that could be among the neighbours of a node are there. Nodes with
+// fewer than two neighbours count as 0.
+func (g Graph) Clustering() float64 {
+	if len(g) == 0 {
+		return 0
+	}
+
+	u := g.undirected()
+	var sum float64
+	for _, ns := range u {
+		k := len(ns)
+		if k < 2 {
+			continue
+		}
+		links := 0
+		for a := range ns {
+			for b := range ns {
+				if a < b && u[a][b] {
+					links++
+				}
+			}
+		}
+		sum += float64(links) / float64(k*(k-1)/2)
+	}
+	return sum / float64(len(g))
+}
+
+// PathLength returns the average length of the shortest paths from sources
+// to the nodes they can reach.
+func (g Graph) PathLength(sources []string) float64 {
+	u := g.undirected()
+	var total, paths int
+	for _, src := range sources {
+		dist := map[string]int{src: 0}
+		queue := []string{src}
+		for len(queue) > 0 {
+			v := queue[0]
+			queue = queue[1:]
+			for w := range u[v] {
+				if _, ok := dist[w]; !ok {
+					dist[w] = dist[v] + 1
+					total += dist[w]
+					paths++
+					queue = append(queue, w)
+				}
+			}
+		}
+	}
+	if paths == 0 {
+		return 0
+	}
+	return float64(total) / float64(paths)
+}
+
+// Partitions returns the number of connected parts of g.
+func (g Graph) Partitions() int {
+	u := g.undirected()
+	seen := make(map[string]bool, len(g))
+	parts := 0
+	for _, id := range g.ids() {
+		if seen[id] {
+			continue
+		}
+		parts++
+		seen[id] = true
+		stack := []string{id}
+		for len(stack) > 0 {
+			v := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for w := range u[v] {
+				if !seen[w] {
+					seen[w] = true
+					stack = append(stack, w)
+				}
+			}
+		}
+	}
+	return parts
+}
+
+// Percentile returns the p-th percentile of ds, e.g. 0.9 for the 90th, or
+// 0 if ds is empty. ds is sorted in place.
+func Percentile(ds []time.Duration, p float64) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	i := int(math.Ceil(p*float64(len(ds)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return ds[i]
+}
@@ -0,0 +1,92 @@
+package sim
+
+import (
+	"fmt"
+	"time"
+)
+
+// Step of a scenario.
+type Step struct {
+	Name string
+	Run  func(s *Sim)
+}
+
+// Report on the overlay after a step of a scenario.
+type Report struct {
+	Step string
+	Metrics
+	Broadcast BroadcastStats
+	Took      time.Duration
+}
+
+// Play runs the steps in order. After each, and after Config.Warmup, the
+// overlay is measured and msgs messages are broadcast.
+func (s *Sim) Play(steps []Step, msgs int) []Report {
+	reports := make([]Report, 0, len(steps))
+	for _, st := range steps {
+		start := s.clock.Now()
+		st.Run(s)
+		r := Report{Step: st.Name, Took: s.clock.Now().Sub(start)}
+		<-s.clock.After(s.cfg.Warmup)
+		r.Metrics = s.Measure()
+		r.Broadcast = s.Broadcast(msgs)
+		reports = append(reports, r)
+	}
+	return reports
+}
+
+// JoinWave starts n nodes and then lets them shuffle for the given number
+// of rounds.
+func JoinWave(n, rounds int) Step {
+	return Step{
+		Name: fmt.Sprintf("join %d, %d rounds", n, rounds),
+		Run: func(s *Sim) {
+			s.Join(n)
+			s.Rounds(rounds)
+		},
+	}
+}
+
+// JoinViaFirst is JoinWave with every node introduced to the same one, the
+// oldest running node.
+func JoinViaFirst(n, rounds int) Step {
+	return Step{
+		Name: fmt.Sprintf("join %d via one, %d rounds", n, rounds),
+		Run: func(s *Sim) {
+			alive := s.Alive()
+			if len(alive) == 0 {
+				s.Join(1)
+				n--
+				alive = s.Alive()
+			}
+			s.JoinVia(alive[0], n)
+			s.Rounds(rounds)
+		},
+	}
+}
+
+// Churn replaces n of the nodes with new ones before every round.
+func Churn(n, rounds int) Step {
+	return Step{
+		Name: fmt.Sprintf("churn %d per round, %d rounds", n, rounds),
+		Run: func(s *Sim) {
+			for i := 0; i < rounds; i++ {
+				s.Kill(n)
+				s.Join(n)
+				s.Rounds(1)
+			}
+		},
+	}
+}
+
+// MassFailure stops a share of the nodes at once, e.g. 0.5 for half of
+// them, and lets the rest shuffle for the given number of rounds.
+func MassFailure(share float64, rounds int) Step {
+	return Step{
+		Name: fmt.Sprintf("kill %.0f%%, %d rounds", share*100, rounds),
+		Run: func(s *Sim) {
+			s.Kill(int(share * float64(len(s.nodes))))
+			s.Rounds(rounds)
+		},
+	}
+}
@@ -0,0 +1,357 @@
+// Package sim runs overlays of Cyclon and broadcast nodes over a simulated
+// network and measures them, so that their parameters can be tuned with
+// numbers rather than guesses.
+package sim
+
+import (
+	"encoding/gob"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Gaboose/go-pubsub/clock"
+	cycbro "github.com/Gaboose/go-pubsub/net/cycbro"
+	"github.com/Gaboose/go-pubsub/pnet"
+	"github.com/Gaboose/go-pubsub/pnet/mock"
+	"github.com/Gaboose/go-pubsub/topo/broadcast"
+	"github.com/Gaboose/go-pubsub/topo/cyclon"
+)
+
+func init() {
+	gob.Register(&mock.Peer{})
+}
+
+// Config of a simulation. The first four are the parameters of the nodes,
+// as in cyclon.New, broadcast.New and Broadcast.Start.
+type Config struct {
+	CacheSize  int
+	ShufLen    int
+	Fanout     int
+	BackupSize int
+
+	// TTL is how long broadcast nodes remember the messages they've seen.
+	TTL time.Duration
+
+	// Link connects every pair of nodes.
+	Link mock.Link
+
+	// Warmup is how long broadcast nodes are given after every step of a
+	// scenario to connect to the peers Cyclon passed them.
+	Warmup time.Duration
+
+	// Settle bounds how long a broadcast is waited for to reach every
+	// node.
+	Settle time.Duration
+
+	// Seed of the random choices of the simulation and its network.
+	Seed int64
+
+	// Clock runs the network, the nodes and the waits of the simulation,
+	// and times the deliveries. It's clock.Real if it's nil. A clock.Fake
+	// makes the timings independent of how fast the simulation runs, but
+	// it has to be advanced by the caller while the Sim waits on it.
+	Clock clock.Clock
+}
+
+// DefaultConfig has the parameters of net/cycbro.
+var DefaultConfig = Config{
+	CacheSize:  cycbro.CacheSize,
+	ShufLen:    cycbro.ShufLen,
+	Fanout:     cycbro.Fanout,
+	BackupSize: cycbro.BackupSize,
+	TTL:        time.Minute,
+	Link:       mock.Link{Latency: time.Millisecond},
+	Warmup:     100 * time.Millisecond,
+	Settle:     time.Second,
+	Seed:       1,
+}
+
+// Sim is an overlay of nodes that each run Cyclon and broadcast. Cyclon
+// shuffles in rounds that the Sim drives, all nodes at once.
+type Sim struct {
+	cfg   Config
+	clock clock.Clock
+	net   *mock.Network
+	rng   *rand.Rand
+	nodes map[string]*node
+	next  int
+
+	// recv records when each message reached each node
+	recv    map[string]map[string]time.Time
+	arrived chan struct{} // closed and replaced when a message arrives
+	recvmu  sync.Mutex
+}
+
+type node struct {
+	id   string
+	cyc  *cyclon.Cyclon
+	bro  *broadcast.Broadcast
+	stop chan bool
+}
+
+func New(cfg Config) *Sim {
+	c := cfg.Clock
+	if c == nil {
+		c = clock.Real
+	}
+	n := mock.NewNetworkClock(cfg.Seed, c)
+	n.SetDefaultLink(cfg.Link)
+	return &Sim{
+		cfg:     cfg,
+		clock:   c,
+		net:     n,
+		rng:     rand.New(rand.NewSource(cfg.Seed)),
+		nodes:   make(map[string]*node),
+		recv:    make(map[string]map[string]time.Time),
+		arrived: make(chan struct{}),
+	}
+}
+
+// Network returns the simulated network, e.g. to change its links or
+// partition it.
+func (s *Sim) Network() *mock.Network { return s.net }
+
+// Alive returns the IDs of the running nodes in order.
+func (s *Sim) Alive() []string {
+	ids := make([]string, 0, len(s.nodes))
+	for id := range s.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Join starts n nodes, each introduced to a running node picked at random.
+// The first node of a simulation has nobody to be introduced to.
+func (s *Sim) Join(n int) []string {
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		alive := s.Alive()
+		intro := ""
+		if len(alive) > 0 {
+			intro = alive[s.rng.Intn(len(alive))]
+		}
+		ids = append(ids, s.start(intro))
+	}
+	return ids
+}
+
+// JoinVia starts n nodes that are all introduced to the node intro, like
+// nodes that discover the same peer on a local network.
+func (s *Sim) JoinVia(intro string, n int) []string {
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		ids = append(ids, s.start(intro))
+	}
+	return ids
+}
+
+func (s *Sim) start(intro string) string {
+	id := fmt.Sprintf("n%05d", s.next)
+	s.next++
+
+	nd := &node{
+		id:   id,
+		cyc:  cyclon.New(&mock.Peer{ID: id}, s.cfg.CacheSize, s.cfg.ShufLen, s.net.DialListener(id, cyclon.Proto)),
+		bro:  broadcast.New(s.cfg.Fanout, s.cfg.TTL, s.net.DialListener(id, broadcast.Proto)),
+		stop: make(chan bool),
+	}
+	nd.cyc.Clock = s.clock
+	nd.bro.Clock = s.clock
+
+	// Cyclon closes its output when it stops, but broadcast isn't meant
+	// to see that, so the peers are passed on through a channel of our
+	// own.
+	nd.cyc.Start(0)
+	if intro != "" {
+		nd.cyc.Join(&mock.Peer{ID: intro})
+	}
+	peers := make(chan pnet.Peer)
+	go func() {
+		for p := range nd.cyc.Out() {
+			select {
+			case peers <- p:
+			case <-nd.stop:
+				return
+			}
+		}
+	}()
+
+	nd.bro.Start(peers, s.cfg.BackupSize)
+	go func() {
+		for {
+			select {
+			case msg := <-nd.bro.Out():
+				s.received(msg, id)
+			case <-nd.stop:
+				return
+			}
+		}
+	}()
+
+	s.nodes[id] = nd
+	return id
+}
+
+func (s *Sim) received(msg, id string) {
+	now := s.clock.Now()
+	s.recvmu.Lock()
+	defer s.recvmu.Unlock()
+	if r, ok := s.recv[msg]; ok {
+		if _, ok := r[id]; !ok {
+			r[id] = now
+			close(s.arrived)
+			s.arrived = make(chan struct{})
+		}
+	}
+}
+
+// Kill stops n running nodes picked at random and returns their IDs.
+func (s *Sim) Kill(n int) []string {
+	alive := s.Alive()
+	s.rng.Shuffle(len(alive), func(i, j int) {
+		alive[i], alive[j] = alive[j], alive[i]
+	})
+	if n > len(alive) {
+		n = len(alive)
+	}
+	for _, id := range alive[:n] {
+		s.stop(id)
+	}
+	return alive[:n]
+}
+
+func (s *Sim) stop(id string) {
+	nd := s.nodes[id]
+	delete(s.nodes, id)
+	close(nd.stop)
+	nd.bro.Stop()
+	nd.cyc.Stop()
+}
+
+// Close stops every node.
+func (s *Sim) Close() {
+	for _, id := range s.Alive() {
+		s.stop(id)
+	}
+}
+
+// Rounds makes every running node shuffle n times, all at once, and waits
+// for the shuffles to finish after each round.
+func (s *Sim) Rounds(n int) {
+	for i := 0; i < n; i++ {
+		var wg sync.WaitGroup
+		for _, nd := range s.nodes {
+			wg.Add(1)
+			go func(nd *node) {
+				nd.cyc.Shuffle()
+				wg.Done()
+			}(nd)
+		}
+		wg.Wait()
+	}
+}
+
+// Graph returns the overlay formed by the Cyclon caches.
+func (s *Sim) Graph() Graph {
+	g := make(Graph, len(s.nodes))
+	for id, nd := range s.nodes {
+		peers := nd.cyc.Neighbours()
+		ns := make([]string, 0, len(peers))
+		for _, p := range peers {
+			ns = append(ns, fmt.Sprint(p.Id()))
+		}
+		sort.Strings(ns)
+		g[id] = ns
+	}
+	return g
+}
+
+// Measure computes the metrics of the overlay.
+func (s *Sim) Measure() Metrics {
+	return Measure(s.Graph(), s.rng)
+}
+
+// BroadcastStats describe how well messages spread.
+type BroadcastStats struct {
+	Sent int
+
+	// Reliability is the average share of the other running nodes that
+	// a message reached.
+	Reliability float64
+
+	// Latency percentiles of delivery to the nodes that were reached.
+	P50, P90, P99 time.Duration
+}
+
+// Broadcast sends n messages, one by one, each from a running node picked
+// at random. Each message is waited for until it has reached every other
+// node, or for Config.Settle at most.
+func (s *Sim) Broadcast(n int) BroadcastStats {
+	var st BroadcastStats
+	var latencies []time.Duration
+	var reached float64
+
+	for i := 0; i < n; i++ {
+		alive := s.Alive()
+		if len(alive) < 2 {
+			break
+		}
+		src := alive[s.rng.Intn(len(alive))]
+		msg := fmt.Sprintf("msg %d from %s", s.rng.Int63(), src)
+
+		s.recvmu.Lock()
+		s.recv[msg] = make(map[string]time.Time)
+		s.recvmu.Unlock()
+
+		start := s.clock.Now()
+		s.nodes[src].bro.In() <- msg
+		st.Sent++
+
+		settled := s.clock.NewTimer(s.cfg.Settle)
+	wait:
+		for {
+			got, arrived := s.reached(msg)
+			if got >= len(alive)-1 {
+				break
+			}
+			select {
+			case <-arrived:
+			case <-settled.C:
+				break wait
+			}
+		}
+		settled.Stop()
+
+		s.recvmu.Lock()
+		got := 0
+		for id, at := range s.recv[msg] {
+			if _, ok := s.nodes[id]; ok && id != src {
+				got++
+				latencies = append(latencies, at.Sub(start))
+			}
+		}
+		delete(s.recv, msg)
+		s.recvmu.Unlock()
+
+		reached += float64(got) / float64(len(alive)-1)
+	}
+
+	if st.Sent > 0 {
+		st.Reliability = reached / float64(st.Sent)
+	}
+	st.P50 = Percentile(latencies, 0.5)
+	st.P90 = Percentile(latencies, 0.9)
+	st.P99 = Percentile(latencies, 0.99)
+	return st
+}
+
+// reached returns the number of nodes msg has reached, and a channel that's
+// closed when the next message arrives anywhere.
+func (s *Sim) reached(msg string) (int, <-chan struct{}) {
+	s.recvmu.Lock()
+	defer s.recvmu.Unlock()
+	return len(s.recv[msg]), s.arrived
+}
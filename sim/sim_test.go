@@ -0,0 +1,124 @@
+package sim
+
+import (
+	"math"
+	"math/rand"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/go-pubsub/clock"
+)
+
+func TestMetrics(t *testing.T) {
+	// A triangle, a line hanging off it, and a lone node with a link to a
+	// node that's gone
+	g := Graph{
+		"a": {"b", "c"},
+		"b": {"c"},
+		"c": {"d"},
+		"d": {"e"},
+		"e": {},
+		"f": {"x"},
+	}
+	m := Measure(g, rand.New(rand.NewSource(1)))
+
+	if m.Nodes != 6 {
+		t.Fatalf("expected 6 nodes, got %d", m.Nodes)
+	}
+	if m.DeadLinks != 1 {
+		t.Fatalf("expected 1 dead link, got %d", m.DeadLinks)
+	}
+	if m.Partitions != 2 {
+		t.Fatalf("expected 2 partitions, got %d", m.Partitions)
+	}
+	in := map[int]int{0: 2, 1: 3, 2: 1}
+	for d, n := range in {
+		if m.InDegree[d] != n {
+			t.Fatalf("expected in-degrees %v, got %v", in, m.InDegree)
+		}
+	}
+
+	// a and b are fully clustered, c has 1 of 3 links among its neighbours
+	if want := (1 + 1 + 1.0/3) / 6; math.Abs(m.Clustering-want) > 1e-9 {
+		t.Fatalf("expected clustering %v, got %v", want, m.Clustering)
+	}
+
+	// Along the line, from e: 1, 2, 3 and 3
+	if l := g.PathLength([]string{"e"}); l != 9.0/4 {
+		t.Fatalf("expected path length 2.25, got %v", l)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var ds []time.Duration
+	for i := 100; i > 0; i-- {
+		ds = append(ds, time.Duration(i))
+	}
+	for p, want := range map[float64]time.Duration{0: 1, 0.5: 50, 0.9: 90, 1: 100} {
+		if got := Percentile(ds, p); got != want {
+			t.Fatalf("expected percentile %v to be %v, got %v", p, want, got)
+		}
+	}
+	if Percentile(nil, 0.5) != 0 {
+		t.Fatal("expected 0 for no durations")
+	}
+}
+
+func TestPlay(t *testing.T) {
+	s := New(DefaultConfig)
+	defer s.Close()
+
+	rs := s.Play([]Step{
+		JoinWave(20, 10),
+		Churn(2, 3),
+		MassFailure(0.5, 10),
+	}, 3)
+
+	for i, nodes := range []int{20, 20, 10} {
+		r := rs[i]
+		if r.Nodes != nodes {
+			t.Fatalf("%s: expected %d nodes, got %d", r.Step, nodes, r.Nodes)
+		}
+		if r.Partitions != 1 {
+			t.Fatalf("%s: expected a single partition, got %d", r.Step, r.Partitions)
+		}
+		if r.Broadcast.Sent != 3 || r.Broadcast.Reliability == 0 {
+			t.Fatalf("%s: expected messages to spread, got %+v", r.Step, r.Broadcast)
+		}
+	}
+}
+
+func TestClock(t *testing.T) {
+	c := clock.NewFake(time.Unix(0, 0))
+	cfg := DefaultConfig
+	cfg.Clock = c
+	s := New(cfg)
+	defer s.Close()
+
+	// Time moves a millisecond at a time, whenever something waits for it
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			c.BlockUntil(1)
+			c.Advance(time.Millisecond)
+			runtime.Gosched()
+		}
+	}()
+
+	r := s.Play([]Step{JoinWave(10, 3)}, 3)[0]
+	if r.Broadcast.Sent != 3 || r.Broadcast.Reliability == 0 {
+		t.Fatalf("expected messages to spread, got %+v", r.Broadcast)
+	}
+
+	// Deliveries are timed on the clock, at least a link away
+	if p := r.Broadcast.P50; p < cfg.Link.Latency || p%time.Millisecond != 0 {
+		t.Fatalf("expected whole milliseconds of latency, got %v", p)
+	}
+}
@@ -0,0 +1,267 @@
+package autonat
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Gaboose/go-pubsub/pnet"
+	"github.com/ipfs/go-ipfs/thirdparty/multierr"
+)
+
+// Proto is the protocol of the autonat service.
+const Proto = "/autonat"
+
+// DialBackTimeout bounds how long a server tries each address it's asked to
+// dial back.
+var DialBackTimeout = 10 * time.Second
+
+// RequestInterval is how long a server waits before it answers the same
+// peer again. Requests that come sooner, or while one from the peer is
+// still being answered, are refused.
+var RequestInterval = 30 * time.Second
+
+// MaxAddrs is how many addresses a server dials back per request at most.
+// The rest are reported as unreachable.
+const MaxAddrs = 16
+
+// Reachability tells whether a node can be dialed from outside.
+type Reachability int
+
+const (
+	Unknown Reachability = iota
+	Public               // at least one address was dialed back
+	Private              // none of the addresses were dialed back
+)
+
+func (r Reachability) String() string {
+	switch r {
+	case Public:
+		return "public"
+	case Private:
+		return "private"
+	}
+	return "unknown"
+}
+
+// Prober dials a peer back at one of its addresses over a fresh connection
+// and checks that it's really that peer on the other end.
+//
+// SameHost tells whether addr is on the host that a connection was observed
+// coming from. Servers only dial back addresses that are, so that they
+// can't be made to dial anyone else.
+type Prober interface {
+	Probe(ctx context.Context, id string, addr []byte) error
+	SameHost(observed, addr []byte) bool
+}
+
+type request struct {
+	ID    string // kept for older servers, which dial back whatever it says
+	Addrs [][]byte
+}
+
+type response struct {
+	OK []bool
+}
+
+// AutoNAT service dials peers back at their addresses on request, so that
+// they can learn which of them are reachable from outside. Its ProtoNet's
+// streams must be pnet.PeerStreams, for it to know who's asking.
+type AutoNAT struct {
+	ProtoNet pnet.ProtoNet
+	Prober   Prober
+	ln       pnet.Listener
+
+	asked   map[string]time.Time // when each peer last made a request
+	askedmu sync.Mutex
+}
+
+// Serve starts answering dial back requests.
+func (a *AutoNAT) Serve() {
+	if a.ln != nil {
+		panic(errors.New("autonat is already serving"))
+	}
+
+	ln := a.ProtoNet.Listen()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go a.handle(c)
+		}
+	}()
+
+	a.ln = ln
+}
+
+// Stop closes the listener inside.
+func (a *AutoNAT) Stop() {
+	a.ln.Close()
+}
+
+// handle dials the peer on the other end of c back at the addresses it asks
+// for. The ID in the request is ignored for the one the peer authenticated
+// with, and addresses on other hosts are reported as unreachable.
+func (a *AutoNAT) handle(c io.ReadWriteCloser) {
+	defer c.Close()
+
+	ps, ok := c.(pnet.PeerStream)
+	if !ok {
+		return
+	}
+	id, ok := ps.RemotePeer().(string)
+	if !ok || id == "" || !a.allow(id) {
+		return
+	}
+
+	var req request
+	err := gob.NewDecoder(c).Decode(&req)
+	if err != nil {
+		return
+	}
+
+	observed := ps.ObservedAddr()
+	resp := response{OK: make([]bool, len(req.Addrs))}
+	var wg sync.WaitGroup
+	for i, addr := range req.Addrs {
+		if i == MaxAddrs {
+			break
+		}
+		if !a.Prober.SameHost(observed, addr) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, addr []byte) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), DialBackTimeout)
+			defer cancel()
+			resp.OK[i] = a.Prober.Probe(ctx, id, addr) == nil
+		}(i, addr)
+	}
+	wg.Wait()
+
+	gob.NewEncoder(c).Encode(resp)
+}
+
+// allow tells whether the peer id may make a request now, and if so,
+// records that it did. Peers that haven't asked for RequestInterval are
+// forgotten.
+func (a *AutoNAT) allow(id string) bool {
+	a.askedmu.Lock()
+	defer a.askedmu.Unlock()
+
+	now := time.Now()
+	if a.asked == nil {
+		a.asked = make(map[string]time.Time)
+	}
+	for p, t := range a.asked {
+		if now.Sub(t) >= RequestInterval {
+			delete(a.asked, p)
+		}
+	}
+	if _, ok := a.asked[id]; ok {
+		return false
+	}
+	a.asked[id] = now
+	return true
+}
+
+// Result of a reachability check.
+type Result struct {
+	Reachability Reachability
+
+	// Confirmed are the addresses that at least one server dialed back.
+	Confirmed [][]byte
+}
+
+// Check asks servers to dial us, the peer id, back at addrs. They're asked
+// in parallel and an address is confirmed if any of them reaches it. An
+// error is returned only if none of the servers answered, in which case
+// the reachability is Unknown. Check gives up as soon as ctx is done.
+func Check(ctx context.Context, d pnet.Dialer, servers []pnet.Peer, id string, addrs [][]byte) (Result, error) {
+	if len(servers) == 0 {
+		return Result{}, errors.New("no autonat servers")
+	}
+
+	type answer struct {
+		resp response
+		err  error
+	}
+	answers := make(chan answer, len(servers))
+	for _, s := range servers {
+		go func(s pnet.Peer) {
+			resp, err := ask(ctx, d, s, request{id, addrs})
+			answers <- answer{resp, err}
+		}(s)
+	}
+
+	ok := make([]bool, len(addrs))
+	answered := false
+	retErr := multierr.New()
+	retErr.Errors = make([]error, 0, len(servers))
+	for range servers {
+		a := <-answers
+		if a.err != nil {
+			retErr.Errors = append(retErr.Errors, a.err)
+			continue
+		}
+
+		answered = true
+		for i := range ok {
+			ok[i] = ok[i] || (i < len(a.resp.OK) && a.resp.OK[i])
+		}
+	}
+
+	if !answered {
+		if ctx.Err() != nil {
+			return Result{}, ctx.Err()
+		}
+		return Result{}, retErr
+	}
+
+	res := Result{Reachability: Private}
+	for i, addr := range addrs {
+		if ok[i] {
+			res.Confirmed = append(res.Confirmed, addr)
+		}
+	}
+	if len(res.Confirmed) > 0 {
+		res.Reachability = Public
+	}
+	return res, nil
+}
+
+func ask(ctx context.Context, d pnet.Dialer, server pnet.Peer, req request) (response, error) {
+	c, err := d.DialContext(ctx, server)
+	if err != nil {
+		return response{}, err
+	}
+	defer c.Close()
+
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	var resp response
+	err = gob.NewEncoder(c).Encode(req)
+	if err == nil {
+		err = gob.NewDecoder(c).Decode(&resp)
+	}
+
+	if ctx.Err() != nil {
+		return response{}, ctx.Err()
+	}
+	return resp, err
+}
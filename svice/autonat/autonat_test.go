@@ -0,0 +1,132 @@
+package autonat
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Gaboose/go-pubsub/pnet"
+	"github.com/Gaboose/go-pubsub/pnet/mock"
+)
+
+// prober reaches the addresses it's been given only. Addresses look like
+// "<peer id>/<name>", and mock peers are observed at their ids.
+type prober map[string]bool
+
+func (p prober) Probe(ctx context.Context, id string, addr []byte) error {
+	if !p[string(addr)] {
+		return errors.New("unreachable")
+	}
+	if !strings.HasPrefix(string(addr), id+"/") {
+		return errors.New("another peer answered")
+	}
+	return nil
+}
+
+func (p prober) SameHost(observed, addr []byte) bool {
+	return strings.HasPrefix(string(addr), string(observed)+"/")
+}
+
+func TestCheck(t *testing.T) {
+	sw := mock.ProtoNetSwarm{}
+
+	a0 := &AutoNAT{ProtoNet: sw.DialListener("peer0"), Prober: prober{"peer2/a": true}}
+	a0.Serve()
+	defer a0.Stop()
+	a1 := &AutoNAT{ProtoNet: sw.DialListener("peer1"), Prober: prober{"peer2/b": true}}
+	a1.Serve()
+	defer a1.Stop()
+
+	servers := []pnet.Peer{&mock.Peer{ID: "peer0"}, &mock.Peer{ID: "peer1"}}
+	addrs := [][]byte{[]byte("peer2/a"), []byte("peer2/b"), []byte("peer2/c")}
+
+	res, err := Check(context.Background(), sw.DialListener("peer2"), servers, "peer2", addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reachability != Public {
+		t.Fatalf("expected %v, got %v", Public, res.Reachability)
+	}
+	if len(res.Confirmed) != 2 || string(res.Confirmed[0]) != "peer2/a" || string(res.Confirmed[1]) != "peer2/b" {
+		t.Fatalf("expected [a b] to be confirmed, got %q", res.Confirmed)
+	}
+}
+
+func TestPrivate(t *testing.T) {
+	sw := mock.ProtoNetSwarm{}
+
+	a := &AutoNAT{ProtoNet: sw.DialListener("peer0"), Prober: prober{}}
+	a.Serve()
+	defer a.Stop()
+
+	servers := []pnet.Peer{&mock.Peer{ID: "peer0"}}
+	addrs := [][]byte{[]byte("peer1/a")}
+
+	res, err := Check(context.Background(), sw.DialListener("peer1"), servers, "peer1", addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reachability != Private {
+		t.Fatalf("expected %v, got %v", Private, res.Reachability)
+	}
+}
+
+func TestSpoof(t *testing.T) {
+	sw := mock.ProtoNetSwarm{}
+
+	a := &AutoNAT{ProtoNet: sw.DialListener("peer0"), Prober: prober{"peer1/a": true, "peer2/a": true}}
+	a.Serve()
+	defer a.Stop()
+
+	// peer1 pretends to be peer2, and asks for addresses of both. Only its
+	// own is dialed back, as itself.
+	servers := []pnet.Peer{&mock.Peer{ID: "peer0"}}
+	addrs := [][]byte{[]byte("peer2/a"), []byte("peer1/a")}
+
+	res, err := Check(context.Background(), sw.DialListener("peer1"), servers, "peer2", addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Confirmed) != 1 || string(res.Confirmed[0]) != "peer1/a" {
+		t.Fatalf("expected [peer1/a] to be confirmed, got %q", res.Confirmed)
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	sw := mock.ProtoNetSwarm{}
+
+	a := &AutoNAT{ProtoNet: sw.DialListener("peer0"), Prober: prober{"peer1/a": true}}
+	a.Serve()
+	defer a.Stop()
+
+	servers := []pnet.Peer{&mock.Peer{ID: "peer0"}}
+	addrs := [][]byte{[]byte("peer1/a")}
+
+	_, err := Check(context.Background(), sw.DialListener("peer1"), servers, "peer1", addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Asking again right away is refused, but others can still ask
+	_, err = Check(context.Background(), sw.DialListener("peer1"), servers, "peer1", addrs)
+	if err == nil {
+		t.Fatal("expected the second request to be refused")
+	}
+	_, err = Check(context.Background(), sw.DialListener("peer2"), servers, "peer2", addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoServers(t *testing.T) {
+	sw := mock.ProtoNetSwarm{}
+
+	servers := []pnet.Peer{&mock.Peer{ID: "peer0"}}
+	addrs := [][]byte{[]byte("a")}
+
+	_, err := Check(context.Background(), sw.DialListener("peer1"), servers, "peer1", addrs)
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+}
@@ -0,0 +1,128 @@
+package identify
+
+import (
+	"encoding/gob"
+	"io"
+	"sync"
+
+	"github.com/Gaboose/go-pubsub/pnet/peerstore"
+)
+
+// Proto is the protocol of the identify service.
+const Proto = "/identify/1.0.0"
+
+// AgentVersion is what this implementation calls itself.
+var AgentVersion = "go-pubsub/0.1.0"
+
+// Names of the peerstore metadata set by the service
+const (
+	AgentKey    = "agent"
+	ObservedKey = "observed"
+)
+
+// maxObserved is how many of our observed addresses are remembered.
+const maxObserved = 16
+
+// MaxListenAddrs is how many of the addresses a peer listens on are recorded
+// at most. The rest are ignored.
+const MaxListenAddrs = 16
+
+// Info is what peers tell each other about themselves.
+type Info struct {
+	ListenAddrs  [][]byte
+	ObservedAddr []byte // where the receiver was seen from
+	Protocols    []string
+	AgentVersion string
+}
+
+// Host is the node that the identify service speaks for.
+type Host interface {
+	ListenAddrs() [][]byte
+	Protocols() []string
+}
+
+// Identify service tells peers about us and records what they tell about
+// themselves in the peerstore. Both ends of a new connection are meant to
+// Request each other's Info.
+type Identify struct {
+	Host      Host
+	Peerstore *peerstore.Peerstore
+
+	// Dialable tells which of the addresses peers listen on are worth
+	// recording. All of them are, up to MaxListenAddrs, if it's nil.
+	Dialable func(addr []byte) bool
+
+	observed   [][]byte
+	observedmu sync.Mutex
+}
+
+// Handle answers a request for our Info. observed is the address the
+// requester is seen from, or nil if it's unknown.
+func (id *Identify) Handle(w io.Writer, observed []byte) error {
+	info := Info{
+		ListenAddrs:  id.Host.ListenAddrs(),
+		ObservedAddr: observed,
+		Protocols:    id.Host.Protocols(),
+		AgentVersion: AgentVersion,
+	}
+	return gob.NewEncoder(w).Encode(info)
+}
+
+// Request reads the Info of peer from r, which is a stream with Proto
+// selected, and records it. Only the listen addresses that are recorded are
+// returned.
+func (id *Identify) Request(r io.Reader, peer string) (Info, error) {
+	var info Info
+	err := gob.NewDecoder(r).Decode(&info)
+	if err != nil {
+		return Info{}, err
+	}
+	info.ListenAddrs = id.dialable(info.ListenAddrs)
+
+	id.Peerstore.AddAddrs(peer, info.ListenAddrs, peerstore.ConnectedAddrTTL)
+	id.Peerstore.SetProtocols(peer, info.Protocols)
+	id.Peerstore.Put(peer, AgentKey, info.AgentVersion)
+	if info.ObservedAddr != nil {
+		id.Peerstore.Put(peer, ObservedKey, info.ObservedAddr)
+		id.addObserved(info.ObservedAddr)
+	}
+	return info, nil
+}
+
+// dialable returns the first MaxListenAddrs of addrs that Dialable lets
+// through.
+func (id *Identify) dialable(addrs [][]byte) [][]byte {
+	var ok [][]byte
+	for _, a := range addrs {
+		if len(ok) == MaxListenAddrs {
+			break
+		}
+		if id.Dialable == nil || id.Dialable(a) {
+			ok = append(ok, a)
+		}
+	}
+	return ok
+}
+
+func (id *Identify) addObserved(addr []byte) {
+	id.observedmu.Lock()
+	defer id.observedmu.Unlock()
+
+	for _, a := range id.observed {
+		if string(a) == string(addr) {
+			return
+		}
+	}
+	if len(id.observed) == maxObserved {
+		id.observed = id.observed[1:]
+	}
+	id.observed = append(id.observed, addr)
+}
+
+// ObservedAddrs returns the addresses other peers have seen us at, most
+// recently first seen last.
+func (id *Identify) ObservedAddrs() [][]byte {
+	id.observedmu.Lock()
+	defer id.observedmu.Unlock()
+	return append([][]byte(nil), id.observed...)
+}
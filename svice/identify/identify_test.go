@@ -0,0 +1,82 @@
+package identify
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/Gaboose/go-pubsub/pnet/peerstore"
+)
+
+type host struct{}
+
+func (host) ListenAddrs() [][]byte { return [][]byte{[]byte("addr")} }
+func (host) Protocols() []string   { return []string{"/foo"} }
+
+// manyAddrs is a host that listens on a lot of addresses.
+type manyAddrs [][]byte
+
+func (h manyAddrs) ListenAddrs() [][]byte { return h }
+func (manyAddrs) Protocols() []string     { return nil }
+
+func TestRequest(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	id0 := &Identify{Host: host{}, Peerstore: peerstore.New()}
+	id1 := &Identify{Host: host{}, Peerstore: peerstore.New()}
+
+	go id1.Handle(c2, []byte("observed"))
+	_, err := id0.Request(c1, "peer1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps := id0.Peerstore
+	if addrs := ps.Addrs("peer1"); len(addrs) != 1 || string(addrs[0]) != "addr" {
+		t.Fatalf("expected [addr], got %q", addrs)
+	}
+	if protos := ps.Protocols("peer1"); len(protos) != 1 || protos[0] != "/foo" {
+		t.Fatalf("expected [/foo], got %v", protos)
+	}
+	if agent := ps.Get("peer1", AgentKey); agent != AgentVersion {
+		t.Fatalf("expected %s, got %v", AgentVersion, agent)
+	}
+	if obs := id0.ObservedAddrs(); len(obs) != 1 || string(obs[0]) != "observed" {
+		t.Fatalf("expected [observed], got %q", obs)
+	}
+}
+
+func TestListenAddrs(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	var h manyAddrs
+	for i := 0; i < 2*MaxListenAddrs; i++ {
+		h = append(h, []byte("bad"), []byte(fmt.Sprintf("addr%d", i)))
+	}
+	id0 := &Identify{
+		Host:      host{},
+		Peerstore: peerstore.New(),
+		Dialable:  func(addr []byte) bool { return string(addr) != "bad" },
+	}
+	id1 := &Identify{Host: h, Peerstore: peerstore.New()}
+
+	go id1.Handle(c2, nil)
+	_, err := id0.Request(c1, "peer1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrs := id0.Peerstore.Addrs("peer1")
+	if len(addrs) != MaxListenAddrs {
+		t.Fatalf("expected %d addresses, got %d", MaxListenAddrs, len(addrs))
+	}
+	for _, a := range addrs {
+		if string(a) == "bad" {
+			t.Fatal("expected the undialable address to be dropped")
+		}
+	}
+}
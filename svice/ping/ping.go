@@ -1,6 +1,7 @@
 package ping
 
 import (
+	"context"
 	"errors"
 
 	"github.com/Gaboose/go-pubsub/pnet"
@@ -15,30 +16,36 @@ const msg = "pong"
 // left there in limbo: no data is exchanged and the connection is left open
 // indefinitely.
 //
-// Now they can be timed out when we wait too long on the "pong" message.
+// Now they can be timed out by giving Ping a context with a deadline.
 type Ping struct {
 	ProtoNet pnet.ProtoNet
 	ln       pnet.Listener
 }
 
 // Ping returns nil if a predefined response is received,
-// otherwise returns an error.
-func (p *Ping) Ping(t pnet.Peer, stop chan bool) error {
-	c, err := p.ProtoNet.Dial(t)
+// otherwise returns an error. It gives up as soon as ctx is done.
+func (p *Ping) Ping(ctx context.Context, t pnet.Peer) error {
+	c, err := p.ProtoNet.DialContext(ctx, t)
 	if err != nil {
 		return err
 	}
 	defer c.Close()
 
-	if stop != nil {
-		go func() {
-			<-stop
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
 			c.Close()
-		}()
-	}
+		case <-done:
+		}
+	}()
 
 	bs := make([]byte, 256)
 	n, err := c.Read(bs)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if err != nil {
 		return err
 	}
@@ -1,6 +1,7 @@
 package ping
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -15,7 +16,7 @@ func TestSucceed(t *testing.T) {
 	ping1.Serve()
 	defer ping1.Stop()
 
-	err := ping0.Ping(&mock.Peer{ID: "peer1"}, nil)
+	err := ping0.Ping(context.Background(), &mock.Peer{ID: "peer1"})
 	if err != nil {
 		t.Fatalf("expected no error, got '%v'", err)
 	}
@@ -32,11 +33,11 @@ func TestTimeout(t *testing.T) {
 	// pinger
 	ping := &Ping{ProtoNet: sw.DialListener("peer1")}
 	done := make(chan error)
-	stop := make(chan bool)
+	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		done <- ping.Ping(&mock.Peer{ID: "peer0"}, stop)
+		done <- ping.Ping(ctx, &mock.Peer{ID: "peer0"})
 	}()
-	
+
 	// accept, but don't respond
 	c, err := ln.Accept()
 	if err != nil {
@@ -44,7 +45,7 @@ func TestTimeout(t *testing.T) {
 	}
 	defer c.Close()
 
-	close(stop)
+	cancel()
 
 	err = <-done
 	if err == nil {
@@ -64,7 +65,7 @@ func TestDelayedResponse(t *testing.T) {
 	ping := &Ping{ProtoNet: sw.DialListener("peer1")}
 	done := make(chan error)
 	go func() {
-		done <- ping.Ping(&mock.Peer{ID: "peer0"}, nil)
+		done <- ping.Ping(context.Background(), &mock.Peer{ID: "peer0"})
 	}()
 
 	// accept and respond after a delay
@@ -87,7 +88,7 @@ func TestFail(t *testing.T) {
 	sw := mock.ProtoNetSwarm{}
 	ping0 := &Ping{ProtoNet: sw.DialListener("peer0")}
 
-	err := ping0.Ping(&mock.Peer{ID: "peer1"}, nil)
+	err := ping0.Ping(context.Background(), &mock.Peer{ID: "peer1"})
 	if err == nil {
 		t.Fatal("expected an error, got nil")
 	}
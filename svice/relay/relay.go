@@ -0,0 +1,267 @@
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Gaboose/go-pubsub/pnet"
+)
+
+// Protocols of the relay service. Peers ask a relay to connect them with
+// HopProto, and the relay reaches the destination with StopProto.
+const (
+	HopProto  = "/relay/hop"
+	StopProto = "/relay/stop"
+)
+
+// DialTimeout bounds how long a relay tries to reach a destination.
+var DialTimeout = 10 * time.Second
+
+// Limits of a relay. It forwards up to MaxCircuits streams at a time, and up
+// to MaxCircuitsPerPeer of them for the same peer; the rest are refused. A
+// forwarded stream is closed after CircuitDuration, or once CircuitBytes
+// have gone through it either way. There's no limit where they're 0. A
+// relay reads them when it starts serving.
+var (
+	MaxCircuits              = 128
+	MaxCircuitsPerPeer       = 8
+	CircuitDuration          = time.Hour
+	CircuitBytes       int64 = 64 << 20
+)
+
+// maxMsg is the longest message in the relay protocol.
+const maxMsg = 1024
+
+// Relay service forwards streams between peers that can't dial each other,
+// e.g. because one of them is behind a NAT. It's run by publicly reachable
+// nodes.
+//
+// A relay only reaches peers that keep a connection open with it, as far
+// as Connected tells. Everything it forwards is encrypted end to end, so it sees nothing but
+// the peer IDs.
+type Relay struct {
+	// ProtoNet for HopProto, where peers ask to be connected.
+	ProtoNet pnet.ProtoNet
+
+	// StopNet dials StopProto to reach the destinations. It mustn't
+	// listen, because the gateway takes relayed streams itself.
+	StopNet pnet.Dialer
+
+	// Connected tells whether there's a connection with the peer id.
+	// Streams are only forwarded to those peers, unless it's nil.
+	Connected func(id string) bool
+
+	ln     pnet.Listener
+	limits limits
+
+	circuits int
+	perPeer  map[interface{}]int // circuits by the peer that asked for them
+	mu       sync.Mutex
+}
+
+// Serve starts forwarding streams.
+func (r *Relay) Serve() {
+	if r.ln != nil {
+		panic(errors.New("relay is already serving"))
+	}
+
+	r.limits = limits{MaxCircuits, MaxCircuitsPerPeer, CircuitDuration, CircuitBytes}
+	ln := r.ProtoNet.Listen()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.handle(c)
+		}
+	}()
+
+	r.ln = ln
+}
+
+// Stop closes the listener inside. Streams already being forwarded are
+// left alone.
+func (r *Relay) Stop() {
+	r.ln.Close()
+}
+
+func (r *Relay) handle(c io.ReadWriteCloser) {
+	dst, err := readMsg(c)
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	// Streams that don't tell who's on the other end are all counted as
+	// the same peer
+	var src interface{}
+	if ps, ok := c.(pnet.PeerStream); ok {
+		src = ps.RemotePeer()
+	}
+	if r.Connected != nil && !r.Connected(dst) {
+		writeMsg(c, "not connected with the destination")
+		c.Close()
+		return
+	}
+	if !r.acquire(src) {
+		writeMsg(c, "too many circuits")
+		c.Close()
+		return
+	}
+	defer r.release(src)
+
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	d, err := r.StopNet.DialContext(ctx, peerID(dst))
+	cancel()
+	if err != nil {
+		writeMsg(c, err.Error())
+		c.Close()
+		return
+	}
+
+	err = writeMsg(c, "")
+	if err != nil {
+		c.Close()
+		d.Close()
+		return
+	}
+
+	if r.limits.duration > 0 {
+		t := time.AfterFunc(r.limits.duration, func() {
+			c.Close()
+			d.Close()
+		})
+		defer t.Stop()
+	}
+
+	done := make(chan bool)
+	go func() {
+		pipe(c, d, r.limits.bytes)
+		close(done)
+	}()
+	pipe(d, c, r.limits.bytes)
+	<-done
+}
+
+// limits are the values of the package's limits when a relay started.
+type limits struct {
+	circuits, perPeer int
+	duration          time.Duration
+	bytes             int64
+}
+
+// acquire counts a new circuit for the peer src, unless there are too many
+// already.
+func (r *Relay) acquire(src interface{}) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.limits.circuits > 0 && r.circuits >= r.limits.circuits {
+		return false
+	}
+	if r.limits.perPeer > 0 && r.perPeer[src] >= r.limits.perPeer {
+		return false
+	}
+	if r.perPeer == nil {
+		r.perPeer = make(map[interface{}]int)
+	}
+	r.circuits++
+	r.perPeer[src]++
+	return true
+}
+
+// release uncounts a circuit of src.
+func (r *Relay) release(src interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.circuits--
+	if r.perPeer[src]--; r.perPeer[src] == 0 {
+		delete(r.perPeer, src)
+	}
+}
+
+// Connect asks a relay to connect us with the peer dst. c is a stream to the
+// relay with HopProto selected. Once Connect returns nil, whatever is
+// written to c goes to dst and vice versa. Connect gives up as soon as ctx
+// is done.
+func Connect(ctx context.Context, c io.ReadWriteCloser, dst string) error {
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	err := writeMsg(c, dst)
+	if err == nil {
+		var resp string
+		resp, err = readMsg(c)
+		if err == nil && resp != "" {
+			err = errors.New("relay: " + resp)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// pipe copies from src to dst until either of them fails, or limit bytes
+// have been copied if it isn't 0, and closes both.
+func pipe(dst io.WriteCloser, src io.ReadCloser, limit int64) {
+	if limit > 0 {
+		io.CopyN(dst, src, limit)
+	} else {
+		io.Copy(dst, src)
+	}
+	dst.Close()
+	src.Close()
+}
+
+// Messages are length prefixed, so that nothing beyond them is read off the
+// stream.
+func writeMsg(w io.Writer, msg string) error {
+	if len(msg) > maxMsg {
+		msg = msg[:maxMsg]
+	}
+	bs := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(bs, uint16(len(msg)))
+	copy(bs[2:], msg)
+	_, err := w.Write(bs)
+	return err
+}
+
+func readMsg(r io.Reader) (string, error) {
+	var hdr [2]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return "", err
+	}
+
+	size := binary.BigEndian.Uint16(hdr[:])
+	if size > maxMsg {
+		return "", errors.New("relay message too long")
+	}
+
+	bs := make([]byte, size)
+	_, err = io.ReadFull(r, bs)
+	return string(bs), err
+}
+
+// peerID is a pnet.Peer known by ID only. Dialing it goes by the
+// connection with it, or the addresses StopNet knows it by.
+type peerID string
+
+func (p peerID) Id() interface{}         { return string(p) }
+func (p peerID) Get(string) interface{}  { return nil }
+func (p peerID) Put(string, interface{}) {}
@@ -0,0 +1,247 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/go-pubsub/pnet/mock"
+)
+
+func TestRelay(t *testing.T) {
+	hopSw := mock.ProtoNetSwarm{}
+	stopSw := mock.ProtoNetSwarm{}
+
+	r := &Relay{
+		ProtoNet: hopSw.DialListener("relay"),
+		StopNet:  stopSw.DialListener("relay"),
+	}
+	r.Serve()
+	defer r.Stop()
+
+	// destination echoes back
+	ln := stopSw.DialListener("peer1").Listen()
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	c, err := hopSw.DialListener("peer0").Dial(&mock.Peer{ID: "relay"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = Connect(context.Background(), c, "peer1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(c, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("expected hello, got %s", buf)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	hopSw := mock.ProtoNetSwarm{}
+	stopSw := mock.ProtoNetSwarm{}
+
+	r := &Relay{
+		ProtoNet: hopSw.DialListener("relay"),
+		StopNet:  stopSw.DialListener("relay"),
+	}
+	r.Serve()
+	defer r.Stop()
+
+	c, err := hopSw.DialListener("peer0").Dial(&mock.Peer{ID: "relay"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = Connect(context.Background(), c, "peer1")
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+}
+
+func TestNotConnected(t *testing.T) {
+	hopSw := mock.ProtoNetSwarm{}
+	stopSw := mock.ProtoNetSwarm{}
+
+	r := &Relay{
+		ProtoNet:  hopSw.DialListener("relay"),
+		StopNet:   stopSw.DialListener("relay"),
+		Connected: func(id string) bool { return id == "peer1" },
+	}
+	r.Serve()
+	defer r.Stop()
+
+	// peer2 could be dialed, but it isn't connected with the relay
+	ln := stopSw.DialListener("peer2").Listen()
+	defer ln.Close()
+
+	c, err := hopSw.DialListener("peer0").Dial(&mock.Peer{ID: "relay"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = Connect(context.Background(), c, "peer2")
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	defer func(n int) { MaxCircuitsPerPeer = n }(MaxCircuitsPerPeer)
+	MaxCircuitsPerPeer = 1
+
+	hopSw := mock.ProtoNetSwarm{}
+	stopSw := mock.ProtoNetSwarm{}
+
+	r := &Relay{
+		ProtoNet: hopSw.DialListener("relay"),
+		StopNet:  stopSw.DialListener("relay"),
+	}
+	r.Serve()
+	defer r.Stop()
+
+	ln := stopSw.DialListener("peer1").Listen()
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, c)
+		}
+	}()
+
+	connect := func(src string) error {
+		c, err := hopSw.DialListener(src).Dial(&mock.Peer{ID: "relay"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Connect(context.Background(), c, "peer1")
+	}
+
+	// A second circuit for peer0 is refused, but not one for peer2
+	if err := connect("peer0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect("peer0"); err == nil {
+		t.Fatal("expected the second circuit of peer0 to be refused")
+	}
+	if err := connect("peer2"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCircuitBytes(t *testing.T) {
+	defer func(n int64) { CircuitBytes = n }(CircuitBytes)
+	CircuitBytes = 5
+
+	hopSw := mock.ProtoNetSwarm{}
+	stopSw := mock.ProtoNetSwarm{}
+
+	r := &Relay{
+		ProtoNet: hopSw.DialListener("relay"),
+		StopNet:  stopSw.DialListener("relay"),
+	}
+	r.Serve()
+	defer r.Stop()
+
+	// destination reports what it got
+	ln := stopSw.DialListener("peer1").Listen()
+	defer ln.Close()
+	got := make(chan string, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		bs, _ := ioutil.ReadAll(c)
+		got <- string(bs)
+	}()
+
+	c, err := hopSw.DialListener("peer0").Dial(&mock.Peer{ID: "relay"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = Connect(context.Background(), c, "peer1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go c.Write([]byte("hello world"))
+	if s := <-got; s != "hello" {
+		t.Fatalf("expected the circuit to close after hello, got %q", s)
+	}
+}
+
+func TestCircuitDuration(t *testing.T) {
+	defer func(d time.Duration) { CircuitDuration = d }(CircuitDuration)
+	CircuitDuration = 10 * time.Millisecond
+
+	hopSw := mock.ProtoNetSwarm{}
+	stopSw := mock.ProtoNetSwarm{}
+
+	r := &Relay{
+		ProtoNet: hopSw.DialListener("relay"),
+		StopNet:  stopSw.DialListener("relay"),
+	}
+	r.Serve()
+	defer r.Stop()
+
+	ln := stopSw.DialListener("peer1").Listen()
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			io.Copy(c, c)
+		}
+	}()
+
+	c, err := hopSw.DialListener("peer0").Dial(&mock.Peer{ID: "relay"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = Connect(context.Background(), c, "peer1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is sent, but the circuit is closed all the same
+	read := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Fatal("expected the circuit to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+}
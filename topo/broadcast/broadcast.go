@@ -2,17 +2,36 @@ package broadcast
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"sync"
 	"time"
 
+	"github.com/Gaboose/go-pubsub/clock"
 	"github.com/Gaboose/go-pubsub/pnet"
 	mux "github.com/jbenet/go-multicodec/mux"
 )
 
+// DialTimeout bounds how long connecting to a new neighbour may take.
+// Connections are made while holding the neighbour set lock, so this also
+// bounds how long broadcasting can be held up by an unresponsive peer.
+var DialTimeout = 5 * time.Second
+
+// Proto is the protocol name that Broadcast speaks, versioned so that the
+// message format can evolve. Nodes accept older compatible versions.
+const Proto = "/broadcast/1.0.0"
+
+// NeighbourKey is the name of the peerstore metadata that tells whether a
+// peer is one of our primary neighbours.
+const NeighbourKey = "broadcast.neighbour"
+
+// protectTag marks the connections protected by broadcast.
+const protectTag = "broadcast"
+
 type Msg struct {
 	Id   string
 	Data string
@@ -34,13 +53,22 @@ type Broadcast struct {
 	out         chan string
 	neighbCount chan int
 	stop        chan bool
+	stopOnce    sync.Once
+	stopmu      sync.Mutex // guards stop between Start and Close
+	drained     chan bool  // closed once the last messages have been sent
+	done        chan bool  // closed once the connections are closed
 
+	ttl        time.Duration
 	cache      *ExpiringSet
 	neighbsPri map[io.ReadWriteCloser]Peer
 	neighbsSec map[io.ReadWriteCloser]bool
 	neighbsmu  sync.RWMutex
 
 	Str string
+
+	// Clock expires the messages seen and times out the dials. It's
+	// clock.Real unless it's replaced before Start.
+	Clock clock.Clock
 }
 
 func (b *Broadcast) String() string {
@@ -49,21 +77,27 @@ func (b *Broadcast) String() string {
 
 func New(fanout int, ttl time.Duration, protonet pnet.ProtoNet) *Broadcast {
 	return &Broadcast{
-		cache:       NewExpiringSet(ttl),
+		ttl:         ttl,
 		fanout:      fanout,
 		protonet:    protonet,
 		neighbCount: make(chan int, 1),
 		neighbsPri:  map[io.ReadWriteCloser]Peer{},
 		neighbsSec:  map[io.ReadWriteCloser]bool{},
+		Clock:       clock.Real,
 	}
 }
 
 func (b *Broadcast) Start(peerSampler <-chan pnet.Peer, backupSize int) {
 
+	b.stopmu.Lock()
 	if b.stop != nil {
+		b.stopmu.Unlock()
 		panic(errors.New("Broadcast was already started"))
 	}
 	b.stop = make(chan bool)
+	b.stopmu.Unlock()
+	b.cache = NewExpiringSetClock(b.ttl, b.Clock)
+	b.drained, b.done = make(chan bool), make(chan bool)
 	ready := make(chan bool)
 
 	go func() {
@@ -79,32 +113,89 @@ func (b *Broadcast) Start(peerSampler <-chan pnet.Peer, backupSize int) {
 
 		ln := b.protonet.Listen()
 		go b.connAccepter(ln, newSecNeighbs)
-		defer ln.Close()
 
 		go b.broadcaster(toNeighbs)
-		defer close(toNeighbs)
 
 		go overflowBuffer(30, outBuf, b.out)
-		defer close(outBuf)
 
 		// start service logic goroutines
 
-		go b.msgRouter(b.in, fromNeighbs, toNeighbs, outBuf)
-		defer close(b.in)
+		routerDone := make(chan bool)
+		go func() {
+			b.msgRouter(b.in, fromNeighbs, toNeighbs, outBuf)
+			close(routerDone)
+		}()
 
 		go b.neighbManager(backupSize, peerSampler, newSecNeighbs, fromNeighbs)
 
 		ready <- true
 
 		<-b.stop
+
+		// Tear down in order: stop accepting, let the router pass on
+		// the message it's holding and the broadcaster send out what it
+		// has. The neighbour manager closes the connections after that.
+		// In stays open, so that late senders don't panic.
+		ln.Close()
+		<-routerDone
+		b.cache.Close()
+		close(toNeighbs)
+		close(outBuf)
 	}()
 
 	<-ready
 }
 
+// Stop starts tearing the broadcast down and returns right away. Calling
+// it again does nothing.
 func (b *Broadcast) Stop() {
-	defer recover()
-	close(b.stop)
+	stop := b.stopped()
+	b.stopOnce.Do(func() { close(stop) })
+}
+
+// Stopped returns a channel that's closed once the broadcast is stopped.
+// Messages sent to In after that aren't taken, so senders that may outlive
+// the broadcast should select on both. It's nil before Start.
+func (b *Broadcast) Stopped() <-chan bool { return b.stopped() }
+
+func (b *Broadcast) stopped() chan bool {
+	b.stopmu.Lock()
+	defer b.stopmu.Unlock()
+	return b.stop
+}
+
+// Close stops the broadcast and waits until the messages in flight have
+// reached the neighbours and the connections are closed. If ctx is done
+// first, the connections are closed right away and ctx.Err() is returned.
+func (b *Broadcast) Close(ctx context.Context) error {
+	if b.stopped() == nil {
+		return nil
+	}
+	b.Stop()
+
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	// Closing the connections unblocks the sends in flight
+	b.neighbsmu.Lock()
+	b.closeNeighbs()
+	b.neighbsmu.Unlock()
+	<-b.done
+	return ctx.Err()
+}
+
+// closeNeighbs closes the connections with all neighbours. The caller must
+// hold neighbsmu.
+func (b *Broadcast) closeNeighbs() {
+	for conn := range b.neighbsPri {
+		conn.Close()
+	}
+	for conn := range b.neighbsSec {
+		conn.Close()
+	}
 }
 
 func (b *Broadcast) In() chan<- string          { return b.in }
@@ -112,15 +203,40 @@ func (b *Broadcast) Out() <-chan string         { return b.out }
 func (b *Broadcast) NeighbourCount() <-chan int { return b.neighbCount }
 
 func (b *Broadcast) connect(p Peer, msgCh chan<- msgInfo, closedCh chan<- io.ReadWriteCloser) error {
-	conn, err := b.protonet.Dial(p.Peer)
+	ctx, cancel := clock.WithTimeout(context.Background(), b.Clock, DialTimeout)
+	defer cancel()
+
+	conn, err := b.protonet.DialContext(ctx, p.Peer)
 	if err == nil {
 		p.conn = conn
 		b.neighbsPri[conn] = p
+		b.markNeighbour(p, true)
 		go b.msgAccepter(conn, msgCh, closedCh)
 	}
 	return err
 }
 
+// markNeighbour records in the peerstore, if the protonet has one, whether
+// p is one of our primary neighbours. Connections to primary neighbours are
+// protected from trimming too.
+func (b *Broadcast) markNeighbour(p Peer, yes bool) {
+	if cp, ok := b.protonet.(pnet.ConnProtector); ok {
+		if yes {
+			cp.Protect(p.Peer, protectTag)
+		} else {
+			cp.Unprotect(p.Peer, protectTag)
+		}
+	}
+
+	pp, ok := b.protonet.(pnet.PeerstoreProvider)
+	if !ok {
+		return
+	}
+	if id, ok := p.Id().(string); ok {
+		pp.Peerstore().Put(id, NeighbourKey, yes)
+	}
+}
+
 func (b *Broadcast) outputNeighbCount() {
 	select {
 	case b.neighbCount <- len(b.neighbsPri) + len(b.neighbsSec):
@@ -132,16 +248,15 @@ func (b *Broadcast) msgRouter(fromUser <-chan string,
 	fromNeighbs <-chan msgInfo, toNeighbs chan<- msgInfo, toUser chan<- string) {
 	for {
 		select {
-		case s, ok := <-fromUser:
+		case s := <-fromUser:
 			// Initiate a new broadcast
 
-			if !ok {
-				return
-			}
-
+			// Hex, since the codec may not carry arbitrary bytes in
+			// strings, and the id must come back unchanged for us to
+			// recognise our own message
 			id := make([]byte, 32)
 			rand.Read(id)
-			m := Msg{Id: string(id), Data: s}
+			m := Msg{Id: hex.EncodeToString(id), Data: s}
 
 			b.cache.Add(m.Id)
 			toNeighbs <- msgInfo{&m, nil}
@@ -156,6 +271,10 @@ func (b *Broadcast) msgRouter(fromUser <-chan string,
 				toUser <- mi.msg.Data
 			}
 
+		case <-b.stop:
+			// A message taken from the user before this is passed on
+			// already
+			return
 		}
 	}
 }
@@ -192,6 +311,7 @@ func (b *Broadcast) neighbManager(backupSize int, peerSampler <-chan pnet.Peer,
 				err := b.connect(p, fromNeighbs, connClosed)
 				if err == nil {
 					delete(b.neighbsPri, oldest.conn)
+					b.markNeighbour(*oldest, false)
 					oldest.conn.Close()
 					backup = backup.Insert(*oldest)
 				}
@@ -223,11 +343,13 @@ func (b *Broadcast) neighbManager(backupSize int, peerSampler <-chan pnet.Peer,
 			// neighbour), try to replace it with one of the backup peers.
 
 			b.neighbsmu.Lock()
-			_, isPrimary := b.neighbsPri[conn]
+			p, isPrimary := b.neighbsPri[conn]
 			delete(b.neighbsPri, conn)
 			delete(b.neighbsSec, conn)
 
 			if isPrimary {
+				b.markNeighbour(p, false)
+
 				// try to connect to one of our backup peers
 				// starting from the youngest
 
@@ -245,16 +367,15 @@ func (b *Broadcast) neighbManager(backupSize int, peerSampler <-chan pnet.Peer,
 			b.neighbsmu.Unlock()
 
 		case <-b.stop:
+			// let the messages in flight reach the neighbours first
+			<-b.drained
+
 			b.neighbsmu.Lock()
-			for conn, _ := range b.neighbsPri {
-				conn.Close()
-			}
+			b.closeNeighbs()
 			b.neighbsPri = nil
-			for conn, _ := range b.neighbsSec {
-				conn.Close()
-			}
 			b.neighbsSec = nil
 			b.neighbsmu.Unlock()
+			close(b.done)
 			return
 		}
 	}
@@ -283,17 +404,33 @@ func (b *Broadcast) msgAccepter(rwc io.ReadWriteCloser, out chan<- msgInfo, clos
 		m := &Msg{}
 		err := mx.Decoder(rwc).Decode(m)
 		if err == io.EOF || err == io.ErrClosedPipe {
-			closed <- rwc
+			select {
+			case closed <- rwc:
+			case <-b.stop:
+			}
 			return
 		} else if err != nil {
 			panic(err)
 		}
-		out <- msgInfo{m, rwc}
+
+		select {
+		case out <- msgInfo{m, rwc}:
+		case <-b.stop:
+			return
+		}
 	}
 }
 
 func (b *Broadcast) broadcaster(in <-chan msgInfo) {
 	mx := mux.StandardMux()
+
+	// Once in is closed, wait for the sends in flight to finish
+	var sends sync.WaitGroup
+	defer func() {
+		sends.Wait()
+		close(b.drained)
+	}()
+
 	for {
 		mi, ok := <-in
 		if !ok {
@@ -304,15 +441,23 @@ func (b *Broadcast) broadcaster(in <-chan msgInfo) {
 		mx.Encoder(&buf).Encode(mi.msg)
 		bts := buf.Bytes()
 
+		send := func(conn io.Writer) {
+			sends.Add(1)
+			go func() {
+				io.Copy(conn, bytes.NewReader(bts))
+				sends.Done()
+			}()
+		}
+
 		b.neighbsmu.RLock()
 		for conn, _ := range b.neighbsPri {
 			if mi.sender != conn {
-				go io.Copy(conn, bytes.NewReader(bts))
+				send(conn)
 			}
 		}
 		for conn, _ := range b.neighbsSec {
 			if mi.sender != conn {
-				go io.Copy(conn, bytes.NewReader(bts))
+				send(conn)
 			}
 		}
 		b.neighbsmu.RUnlock()
@@ -1,19 +1,19 @@
 package broadcast
 
 import (
+	"context"
 	"fmt"
 	"runtime"
+	"sort"
 	"strings"
-	"sync"
 	"testing"
 	"time"
 
+	"github.com/Gaboose/go-pubsub/clock"
 	"github.com/Gaboose/go-pubsub/pnet"
 	"github.com/Gaboose/go-pubsub/pnet/mock"
 )
 
-const timeToWait = time.Millisecond
-
 func TestNumGoroutine(t *testing.T) {
 	baseNum := numGoroutine()
 	var num int
@@ -23,9 +23,11 @@ func TestNumGoroutine(t *testing.T) {
 	b.Start(nil, 0)
 	b.Stop()
 
-	ticker := time.NewTicker(timeToWait / 100)
+	// Taking the stacks stops the world, so don't do it too often or the
+	// goroutines never get to exit
+	ticker := time.NewTicker(10 * time.Millisecond)
 	defer ticker.Stop()
-	timeout := time.After(timeToWait)
+	timeout := time.After(time.Second)
 	for {
 		select {
 		case <-ticker.C:
@@ -47,7 +49,10 @@ func TestMsg(t *testing.T) {
 	ps0, ps1 := make(chan pnet.Peer), make(chan pnet.Peer)
 	b0.Start(ps0, 0)
 	b1.Start(ps1, 0)
+	defer b0.Stop()
+	defer b1.Stop()
 	ps0 <- &mock.Peer{ID: "p1"}
+	waitNeighbours(t, b0, []string{"p1"}, 0)
 	b0.In() <- "hello world"
 
 	select {
@@ -55,13 +60,14 @@ func TestMsg(t *testing.T) {
 		if msg != "hello world" {
 			t.Fatalf("expected \"hello world\", got %s", msg)
 		}
-	case <-time.After(timeToWait):
+	case <-time.After(time.Second):
 		t.Fatal("timeout")
 	}
 }
 
 func TestMsgForward(t *testing.T) {
-	sw := mock.ProtoNetSwarm{}
+	c := clock.NewFake(time.Unix(0, 0))
+	sw := mock.ProtoNetSwarm{Clock: c}
 
 	numNodes := 4
 	b, ch := make([]*Broadcast, numNodes), make([]chan pnet.Peer, numNodes)
@@ -70,6 +76,7 @@ func TestMsgForward(t *testing.T) {
 		name := fmt.Sprintf("p%d", i)
 		b[i] = New(1, time.Minute, sw.DialListener(name))
 		b[i].Str = name
+		b[i].Clock = c
 		ch[i] = make(chan pnet.Peer)
 		b[i].Start(ch[i], 2)
 		defer b[i].Stop()
@@ -80,16 +87,20 @@ func TestMsgForward(t *testing.T) {
 	ch[2] <- &mock.Peer{ID: "p0"}
 	ch[3] <- &mock.Peer{ID: "p2"}
 
+	// p3 only hears from p2 over the connection it made itself
+	waitNeighbours(t, b[0], []string{"p1"}, 1)
+	waitNeighbours(t, b[1], []string{"p2"}, 1)
+	waitNeighbours(t, b[2], []string{"p0"}, 2)
+	waitNeighbours(t, b[3], []string{"p2"}, 0)
+
 	b[0].In() <- "hello world"
 
-	testReceive(t,
-		map[*Broadcast]int{b[0]: 0, b[1]: 1, b[2]: 1, b[3]: 1},
-		timeToWait,
-	)
+	testReceive(t, map[*Broadcast]int{b[0]: 0, b[1]: 1, b[2]: 1, b[3]: 1})
 }
 
 func TestNeighbourDiscard(t *testing.T) {
-	sw := mock.ProtoNetSwarm{}
+	c := clock.NewFake(time.Unix(0, 0))
+	sw := mock.ProtoNetSwarm{Clock: c}
 
 	numNodes := 4
 	b, ch := make([]*Broadcast, numNodes), make([]chan pnet.Peer, numNodes)
@@ -98,6 +109,7 @@ func TestNeighbourDiscard(t *testing.T) {
 		name := fmt.Sprintf("p%d", i)
 		b[i] = New(1, time.Minute, sw.DialListener(name))
 		b[i].Str = name
+		b[i].Clock = c
 		ch[i] = make(chan pnet.Peer)
 		b[i].Start(ch[i], 2)
 		defer b[i].Stop()
@@ -106,17 +118,16 @@ func TestNeighbourDiscard(t *testing.T) {
 	ch[0] <- &mock.Peer{"p2", map[string]interface{}{bday: 2}} // keep
 	ch[0] <- &mock.Peer{"p1", map[string]interface{}{bday: 0}} // discard
 	ch[0] <- &mock.Peer{"p3", map[string]interface{}{bday: 1}} // keep
+	waitNeighbours(t, b[0], []string{"p2", "p3"}, 0)
 
 	b[0].In() <- "hello world"
 
-	testReceive(t,
-		map[*Broadcast]int{b[0]: 0, b[1]: 0, b[2]: 1, b[3]: 1},
-		timeToWait,
-	)
+	testReceive(t, map[*Broadcast]int{b[0]: 0, b[1]: 0, b[2]: 1, b[3]: 1})
 }
 
 func TestNeighbourBackup(t *testing.T) {
-	sw := mock.ProtoNetSwarm{}
+	c := clock.NewFake(time.Unix(0, 0))
+	sw := mock.ProtoNetSwarm{Clock: c}
 
 	numNodes := 4
 	b, ch := make([]*Broadcast, numNodes), make([]chan pnet.Peer, numNodes)
@@ -125,6 +136,7 @@ func TestNeighbourBackup(t *testing.T) {
 		name := fmt.Sprintf("p%d", i)
 		b[i] = New(1, time.Minute, sw.DialListener(name))
 		b[i].Str = name
+		b[i].Clock = c
 		ch[i] = make(chan pnet.Peer)
 		b[i].Start(ch[i], 2)
 		defer b[i].Stop()
@@ -134,16 +146,121 @@ func TestNeighbourBackup(t *testing.T) {
 	ch[0] <- &mock.Peer{"p1", map[string]interface{}{bday: 2}} // fail
 	ch[0] <- &mock.Peer{"p2", map[string]interface{}{bday: 1}} // keep
 
+	waitNeighbours(t, b[0], []string{"p1", "p2"}, 0)
+
+	// The backup takes the place of the stopped neighbour
 	b[1].Stop()
+	waitNeighbours(t, b[0], []string{"p2", "p3"}, 0)
+
+	b[0].In() <- "hello world"
+
+	testReceive(t, map[*Broadcast]int{b[0]: 0, b[1]: 0, b[2]: 1, b[3]: 1})
+}
 
-	time.Sleep(timeToWait)
+func TestCrashBackup(t *testing.T) {
+	c := clock.NewFake(time.Unix(0, 0))
+	sw := mock.ProtoNetSwarm{Clock: c}
+
+	numNodes := 4
+	b, ch := make([]*Broadcast, numNodes), make([]chan pnet.Peer, numNodes)
+
+	for i, _ := range b {
+		name := fmt.Sprintf("p%d", i)
+		b[i] = New(1, time.Minute, sw.DialListener(name))
+		b[i].Str = name
+		b[i].Clock = c
+		ch[i] = make(chan pnet.Peer)
+		b[i].Start(ch[i], 2)
+		defer b[i].Stop()
+	}
+
+	ch[0] <- &mock.Peer{"p3", map[string]interface{}{bday: 0}} // backup
+	ch[0] <- &mock.Peer{"p1", map[string]interface{}{bday: 2}} // crash
+	ch[0] <- &mock.Peer{"p2", map[string]interface{}{bday: 1}} // keep
+
+	waitNeighbours(t, b[0], []string{"p1", "p2"}, 0)
+
+	// Unlike a stopped node, a crashed one doesn't close its end, the
+	// swarm does
+	sw.Kill("p1", mock.Crash)
+	waitNeighbours(t, b[0], []string{"p2", "p3"}, 0)
 
 	b[0].In() <- "hello world"
 
-	testReceive(t,
-		map[*Broadcast]int{b[0]: 0, b[1]: 0, b[2]: 1, b[3]: 1},
-		timeToWait,
-	)
+	testReceive(t, map[*Broadcast]int{b[0]: 0, b[1]: 0, b[2]: 1, b[3]: 1})
+}
+
+func TestDialTimeout(t *testing.T) {
+	c := clock.NewFake(time.Unix(0, 0))
+	sw := mock.ProtoNetSwarm{Clock: c, Latency: time.Hour}
+	b0 := New(2, time.Minute, sw.DialListener("p0"))
+	b0.Clock = c
+	b1 := New(2, time.Minute, sw.DialListener("p1"))
+
+	ps0 := make(chan pnet.Peer)
+	b0.Start(ps0, 0)
+	defer b0.Stop()
+	b1.Start(nil, 0)
+	defer b1.Stop()
+
+	// A peer that takes an hour to dial is given up on after DialTimeout
+	sw.Kill("p1", mock.Slow)
+	ps0 <- &mock.Peer{ID: "p1"}
+	c.BlockUntil(2)
+	c.Advance(DialTimeout)
+
+	select {
+	case n := <-b0.NeighbourCount():
+		if n != 0 {
+			t.Fatalf("expected no neighbours, got %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestClose(t *testing.T) {
+	sw := mock.ProtoNetSwarm{}
+	b0 := New(2, time.Minute, sw.DialListener("p0"))
+	b1 := New(2, time.Minute, sw.DialListener("p1"))
+
+	ps0 := make(chan pnet.Peer)
+	b0.Start(ps0, 0)
+	b1.Start(nil, 0)
+	defer b1.Close(context.Background())
+	ps0 <- &mock.Peer{ID: "p1"}
+	<-b0.NeighbourCount()
+
+	// A message sent just before closing still gets through
+	b0.In() <- "hello world"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := b0.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-b1.Out():
+		if msg != "hello world" {
+			t.Fatalf("expected \"hello world\", got %s", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	// Closing again does nothing
+	err = b0.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// and late senders give up instead of panicking
+	select {
+	case b0.In() <- "too late":
+		t.Fatal("expected the message not to be taken")
+	case <-b0.Stopped():
+	}
 }
 
 func numGoroutine() int {
@@ -153,43 +270,48 @@ func numGoroutine() int {
 	return strings.Count(s, "created by github.com")
 }
 
-func testReceive(t *testing.T, expect map[*Broadcast]int, dur time.Duration) {
-	bs := make([]*Broadcast, 0, len(expect))
-	for b, _ := range expect {
-		bs = append(bs, b)
+// testReceive waits for each broadcast to put out the expected number of
+// messages. Once they all have, the messages have spread, so the broadcasts
+// expected to stay quiet must have nothing more to put out.
+func testReceive(t *testing.T, expect map[*Broadcast]int) {
+	for b, n := range expect {
+		for i := 0; i < n; i++ {
+			select {
+			case <-b.Out():
+			case <-time.After(time.Second):
+				t.Fatalf("%v: expected %d messages, got %d", b, n, i)
+			}
+		}
 	}
-	result := receive(bs, dur)
-
-	for b, i := range expect {
-		if len(result[b]) != i {
-			t.Fatalf("expected to receive %v, got %v", expect, result)
+	for b, n := range expect {
+		select {
+		case msg := <-b.Out():
+			t.Fatalf("%v: expected %d messages, got another: %s", b, n, msg)
+		default:
 		}
 	}
 }
 
-func receive(bs []*Broadcast, dur time.Duration) map[*Broadcast][]string {
-	mutex := sync.Mutex{}
-	msgs := map[*Broadcast][]string{}
-	wg := sync.WaitGroup{}
-
-	wg.Add(len(bs))
-
-	listener := func(b *Broadcast) {
-		timeout := time.After(dur)
-		select {
-		case m := <-b.Out():
-			mutex.Lock()
-			msgs[b] = append(msgs[b], m)
-			mutex.Unlock()
-		case <-timeout:
+// waitNeighbours waits until the primary neighbours of b are the peers with
+// the given ids, and it has the given number of secondary ones.
+func waitNeighbours(t *testing.T, b *Broadcast, primary []string, secondary int) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		b.neighbsmu.RLock()
+		got := make([]string, 0, len(b.neighbsPri))
+		for _, p := range b.neighbsPri {
+			got = append(got, fmt.Sprint(p.Id()))
 		}
-		wg.Done()
-	}
+		sec := len(b.neighbsSec)
+		b.neighbsmu.RUnlock()
 
-	for _, b := range bs {
-		go listener(b)
+		sort.Strings(got)
+		if fmt.Sprint(got) == fmt.Sprint(primary) && sec == secondary {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v: expected neighbours %v and %d more, got %v and %d", b, primary, secondary, got, sec)
+		}
+		time.Sleep(time.Millisecond)
 	}
-
-	wg.Wait()
-	return msgs
 }
@@ -4,13 +4,20 @@ import (
 	"io"
 	"sync"
 	"time"
+
+	"github.com/Gaboose/go-pubsub/clock"
 )
 
 type ExpiringSet struct {
 	slice []element
-	set   map[string]bool
+	set   map[string]time.Time // when each entry was added
 	ttl   time.Duration
+	clock clock.Clock
 	mutex sync.RWMutex
+
+	stop    chan bool
+	closed  bool
+	removed sync.WaitGroup // the remover has returned
 }
 
 type element struct {
@@ -19,40 +26,61 @@ type element struct {
 }
 
 func NewExpiringSet(ttl time.Duration) *ExpiringSet {
+	return NewExpiringSetClock(ttl, clock.Real)
+}
+
+// NewExpiringSetClock is like NewExpiringSet, but entries expire on the time
+// of c.
+func NewExpiringSetClock(ttl time.Duration, c clock.Clock) *ExpiringSet {
 	return &ExpiringSet{
 		slice: make([]element, 0),
-		set:   make(map[string]bool),
+		set:   make(map[string]time.Time),
 		ttl:   ttl,
+		clock: c,
+		stop:  make(chan bool),
 	}
 }
 
 func (s *ExpiringSet) Add(v string) {
 	s.mutex.Lock()
-	s.slice = append(s.slice, element{time.Now(), v})
-	s.set[v] = true
-	if len(s.slice) == 1 {
+	now := s.clock.Now()
+	s.slice = append(s.slice, element{now, v})
+	s.set[v] = now
+	if len(s.slice) == 1 && !s.closed {
+		s.removed.Add(1)
 		go s.remover()
 	}
 	s.mutex.Unlock()
 }
 
+// Has tells whether v was added less than the ttl ago. Expired entries are
+// removed in the background, but they're gone as far as Has is concerned
+// as soon as their time has come.
 func (s *ExpiringSet) Has(v string) bool {
 	s.mutex.RLock()
-	_, has := s.set[v]
+	t, has := s.set[v]
 	s.mutex.RUnlock()
-	return has
+	return has && s.clock.Now().Sub(t) < s.ttl
 }
 
 func (s *ExpiringSet) remover() {
+	defer s.removed.Done()
 	for {
 		s.mutex.RLock()
-		timer := time.After(s.ttl - time.Since(s.slice[0].t))
+		timer := s.clock.After(s.ttl - s.clock.Now().Sub(s.slice[0].t))
 		s.mutex.RUnlock()
 
-		<-timer
+		select {
+		case <-timer:
+		case <-s.stop:
+			return
+		}
 
+		// The entry may have been added again since
 		s.mutex.Lock()
-		delete(s.set, s.slice[0].v)
+		if e := s.slice[0]; s.set[e.v].Equal(e.t) {
+			delete(s.set, e.v)
+		}
 		s.slice = s.slice[1:]
 
 		if len(s.slice) == 0 {
@@ -63,6 +91,19 @@ func (s *ExpiringSet) remover() {
 	}
 }
 
+// Close stops removing the expired entries in the background and returns
+// once that's done. Has still tells them apart from the others. Calling it
+// again does nothing.
+func (s *ExpiringSet) Close() {
+	s.mutex.Lock()
+	if !s.closed {
+		close(s.stop)
+		s.closed = true
+	}
+	s.mutex.Unlock()
+	s.removed.Wait()
+}
+
 type NeighbourSet map[io.ReadWriteCloser]Peer
 
 func (s NeighbourSet) Oldest() *Peer {
@@ -3,21 +3,34 @@ package broadcast
 import (
 	"testing"
 	"time"
+
+	"github.com/Gaboose/go-pubsub/clock"
 )
 
 func TestSet(t *testing.T) {
-	s := NewExpiringSet(10 * time.Millisecond)
+	c := clock.NewFake(time.Unix(0, 0))
+	s := NewExpiringSetClock(10*time.Millisecond, c)
+	defer s.Close()
 	s.Add("foo")
 
-	<-time.After(5 * time.Millisecond)
+	c.BlockUntil(1)
+	c.Advance(5 * time.Millisecond)
 
 	if !s.Has("foo") {
 		t.Fatal("entry expired too early")
 	}
 
-	<-time.After(10 * time.Millisecond)
+	c.Advance(5 * time.Millisecond)
 
 	if s.Has("foo") {
 		t.Fatal("entry didn't expire")
 	}
+
+	// Adding it again makes it last another ttl, even though the removal
+	// of the old one may be late
+	s.Add("foo")
+	c.Advance(5 * time.Millisecond)
+	if !s.Has("foo") {
+		t.Fatal("entry added again expired too early")
+	}
 }
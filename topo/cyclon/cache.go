@@ -0,0 +1,120 @@
+package cyclon
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Gaboose/go-pubsub/pnet"
+)
+
+// cacheFile is what Save writes. The peers are gob encoded as interfaces,
+// so their concrete types must be registered, like for shuffling.
+type cacheFile struct {
+	Saved      time.Time
+	Interval   time.Duration // of the shuffles
+	ServiceAge int64
+	Peers      []pnet.Peer
+}
+
+// Save writes the cache, ages included, to the file at path.
+func (c *Cyclon) Save(path string) error {
+	// The peers are encoded under the lock, since shuffles still running
+	// keep aging them
+	var buf bytes.Buffer
+	c.neighbsmu.RLock()
+	f := cacheFile{
+		Saved:      c.Clock.Now(),
+		Interval:   c.interval,
+		ServiceAge: c.serviceAge,
+		Peers:      make([]pnet.Peer, 0, len(c.neighbs)),
+	}
+	for _, p := range c.neighbs {
+		f.Peers = append(f.Peers, p)
+	}
+	err := gob.NewEncoder(&buf).Encode(f)
+	c.neighbsmu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// Write a temporary file and move it in place, so that a crash
+	// doesn't leave half of a cache behind
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load adds the peers of a cache saved at path, as far as they fit. Their
+// ages grow by the shuffles that would have happened since it was saved, so
+// that the peers which had the most time to go away are shuffled with
+// first. A file that doesn't exist is no error, and loads nothing.
+func (c *Cyclon) Load(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var f cacheFile
+	err = gob.NewDecoder(file).Decode(&f)
+	if err != nil {
+		return err
+	}
+
+	var rounds int
+	if downtime := c.Clock.Now().Sub(f.Saved); f.Interval > 0 && downtime > 0 {
+		rounds = int(downtime / f.Interval)
+	}
+
+	c.neighbsmu.Lock()
+	defer c.neighbsmu.Unlock()
+	if sa := f.ServiceAge + int64(rounds); sa > c.serviceAge {
+		c.serviceAge = sa
+	}
+	for _, p := range f.Peers {
+		a, _ := p.Get(age).(int)
+		p.Put(age, a+rounds)
+	}
+	c.updateCache(f.Peers, nil)
+	return nil
+}
+
+// saver saves the cache to c.Cachefile every interval.
+func (c *Cyclon) saver(interval time.Duration) chan bool {
+	stop := make(chan bool)
+	ticker := c.Clock.NewTicker(interval)
+	c.running.Add(1)
+	go func() {
+		defer c.running.Done()
+		for {
+			select {
+			case <-ticker.C:
+				c.Save(c.Cachefile)
+			case <-stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return stop
+}
@@ -8,30 +8,71 @@ package cyclon
 // Journal of Network and Systems Management, 13(2), p.197-216.
 
 import (
+	"context"
 	"errors"
 	//"fmt"
+	"io"
 	"net/rpc"
 	"sync"
 	"time"
 
+	"github.com/Gaboose/go-pubsub/clock"
 	"github.com/Gaboose/go-pubsub/pnet"
 )
 
+// Proto is the protocol name that Cyclon speaks, versioned so that the
+// shuffle format can evolve. Nodes accept older compatible versions.
+const Proto = "/cyclon/1.0.0"
+
 // Names of pnet.Peer parameters
 const age = "age"
 const bday = "bday"
 
+// DialTimeout bounds how long Shuffle waits to connect to a neighbour.
+var DialTimeout = 5 * time.Second
+
+// ShuffleTimeout bounds a whole shuffle with a neighbour, from dialing it
+// to getting its answer.
+var ShuffleTimeout = 10 * time.Second
+
+// ShuffleRetries is how many shuffles in a row a neighbour may fail and
+// still be kept, so that a peer isn't dropped for a passing failure. The
+// paper drops it after the first one.
+var ShuffleRetries = 2
+
+// WalkLength is how many hops the random walks of Join take. The paper
+// sets it to the average path length of the overlay, which the sim package
+// measures.
+var WalkLength = 3
+
 type Cyclon struct {
 	me         pnet.Peer
 	cachesize  int
 	shuflen    int
-	neighbs    PeerSet // our "neighbour set" or "cache"
+	neighbs    PeerSet             // our "neighbour set" or "cache"
+	fails      map[interface{}]int // failed shuffles in a row by neighbour
 	neighbsmu  sync.RWMutex
 	protonet   pnet.ProtoNet
 	serviceAge int64
+	interval   time.Duration
 	out        chan pnet.Peer
 	outBuf     chan pnet.Peer
 	stop       chan bool
+	done       chan bool      // closed once Stop is done
+	running    sync.WaitGroup // the goroutines Stop waits for
+	stats      ShuffleStats
+	statsmu    sync.Mutex
+
+	// Clock paces the shuffles and times out the dials. It's clock.Real
+	// unless it's replaced before Start.
+	Clock clock.Clock
+
+	// Cachefile, if it's set before Start, is where the cache is loaded
+	// from on Start, and saved to every SaveInterval and on Stop. Errors
+	// are ignored, since the cache is only a head start; Load and Save
+	// report them.
+	Cachefile    string
+	SaveInterval time.Duration
 }
 
 func New(me pnet.Peer, cachesize, shuflen int, protonet pnet.ProtoNet) *Cyclon {
@@ -41,7 +82,9 @@ func New(me pnet.Peer, cachesize, shuflen int, protonet pnet.ProtoNet) *Cyclon {
 		cachesize: cachesize,
 		shuflen:   shuflen,
 		neighbs:   make(PeerSet),
+		fails:     make(map[interface{}]int),
 		protonet:  protonet,
+		Clock:     clock.Real,
 	}
 }
 
@@ -49,10 +92,11 @@ func (c *Cyclon) Start(interval time.Duration) {
 	if c.stop != nil {
 		panic(errors.New("Cyclon is already running"))
 	}
-	c.stop = make(chan bool)
+	c.stop, c.done = make(chan bool), make(chan bool)
+	c.interval = interval
 
 	// Start RPC server
-	var stop [2]chan bool
+	var stop [3]chan bool
 	stop[0] = CyclonRPC{c}.serve()
 
 	// Start periodic shuffling
@@ -62,28 +106,78 @@ func (c *Cyclon) Start(interval time.Duration) {
 
 	// Start output buffer
 	c.outBuf, c.out = make(chan pnet.Peer), make(chan pnet.Peer)
-	go overflowBuffer(c.cachesize, c.outBuf, c.out)
+	bufDone := make(chan bool)
+	go func(in <-chan pnet.Peer, out chan<- pnet.Peer) {
+		overflowBuffer(c.cachesize, in, out)
+		close(bufDone)
+	}(c.outBuf, c.out)
+
+	// Pick up where we left off, and keep the cache for next time.
+	// Loading after the buffer is up sends the peers out.
+	if c.Cachefile != "" {
+		c.Load(c.Cachefile)
+		if c.SaveInterval > 0 {
+			stop[2] = c.saver(c.SaveInterval)
+		}
+	}
 
 	go func() {
 		<-c.stop
 		c.stop = nil
 
 		close(stop[0])
-		if stop[1] != nil {
-			close(stop[1])
+		for _, s := range stop[1:] {
+			if s != nil {
+				close(s)
+			}
 		}
-		close(c.outBuf)
+		c.running.Wait()
+
+		// Shuffles still in flight must not send to the closed buffer
+		c.neighbsmu.Lock()
+		outBuf := c.outBuf
+		c.outBuf = nil
+		c.neighbsmu.Unlock()
+		close(outBuf)
+		<-bufDone
+		close(c.done)
 	}()
 }
 
+// Stop stops the periodic shuffles and the server, and returns once they're
+// done. That includes a shuffle in flight, which ShuffleTimeout bounds.
 func (c *Cyclon) Stop() {
+	if c.Cachefile != "" {
+		c.Save(c.Cachefile)
+	}
+	done := c.done
 	close(c.stop)
+	<-done
+}
+
+// Close is like Stop, but stops waiting once ctx is done and returns
+// ctx.Err(). The rest of stopping goes on in the background then.
+func (c *Cyclon) Close(ctx context.Context) error {
+	done := make(chan bool)
+	go func() {
+		c.Stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (c *Cyclon) tick(interval time.Duration) chan bool {
 	stop := make(chan bool)
-	ticker := time.NewTicker(interval)
+	ticker := c.Clock.NewTicker(interval)
+	c.running.Add(1)
 	go func() {
+		defer c.running.Done()
 		for {
 			select {
 			case <-ticker.C:
@@ -97,10 +191,9 @@ func (c *Cyclon) tick(interval time.Duration) chan bool {
 	return stop
 }
 
-// Add adds peers to the cache. You'll need to call this to jumpstart Cyclon.
+// Add adds peers to the cache as they are. To jumpstart Cyclon, Join is
+// gentler on the rest of the overlay.
 func (c *Cyclon) Add(peers ...pnet.Peer) {
-	// TODO: Use random walks instead of shuffling to jumpstart,
-	// like the paper specifies.
 	c.neighbsmu.Lock()
 	for _, p := range peers {
 		p.Put(age, 0)
@@ -109,6 +202,76 @@ func (c *Cyclon) Add(peers ...pnet.Peer) {
 	c.neighbsmu.Unlock()
 }
 
+// Join jumpstarts Cyclon through intro with random walks, like the paper
+// specifies. As many walks as fit in the cache start at intro and take
+// WalkLength hops each. The peer where a walk ends swaps one of its cache
+// entries for us, and we get the entry. Unlike Add, this keeps the
+// in-degrees of the overlay balanced, even when many nodes join through
+// the same peer.
+//
+// If none of the walks get anywhere, intro is added to the cache instead,
+// and the error of the last one is returned.
+func (c *Cyclon) Join(intro pnet.Peer) error {
+	w := Walk{Joiner: c.me, Hops: WalkLength}
+
+	ctx, cancel := clock.WithTimeout(context.Background(), c.Clock, walkTimeout(w.Hops))
+	defer cancel()
+
+	var got []pnet.Peer
+	var err error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < c.cachesize; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var p pnet.Peer
+			_, e := c.call(ctx, intro, "CyclonRPC.HandleWalk", w, &p)
+			mu.Lock()
+			if e == nil {
+				got = append(got, p)
+			} else {
+				err = e
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(got) == 0 {
+		c.Add(intro)
+		return err
+	}
+
+	// Walks may end at the same peers through different paths
+	seen := make(map[interface{}]bool)
+	for i := 0; i < len(got); i++ {
+		if seen[got[i].Id()] {
+			got = append(got[:i], got[i+1:]...)
+			i--
+			continue
+		}
+		seen[got[i].Id()] = true
+	}
+
+	c.neighbsmu.Lock()
+	c.updateCache(got, nil)
+	c.neighbsmu.Unlock()
+	return nil
+}
+
+// Neighbours returns the peers in the cache.
+func (c *Cyclon) Neighbours() []pnet.Peer {
+	c.neighbsmu.RLock()
+	defer c.neighbsmu.RUnlock()
+
+	peers := make([]pnet.Peer, 0, len(c.neighbs))
+	for _, p := range c.neighbs {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
 // Out channel constantly sends new peers from the Cyclon network
 // as they're discovered.
 func (c *Cyclon) Out() <-chan pnet.Peer {
@@ -116,7 +279,9 @@ func (c *Cyclon) Out() <-chan pnet.Peer {
 }
 
 // Shuffle initiates a random exchange of peer profiles with a neighbour of
-// greatest age.
+// greatest age. A neighbour that fails to answer within ShuffleTimeout stays
+// the oldest, so the next shuffle tries it again, and it's dropped once it
+// has failed more than ShuffleRetries shuffles in a row.
 func (c *Cyclon) Shuffle() {
 	c.neighbsmu.Lock()
 	if len(c.neighbs) == 0 {
@@ -136,25 +301,178 @@ func (c *Cyclon) Shuffle() {
 	// Construct the offer. This doesn't remove entries from c.neighbs
 	offer := c.neighbs.Sample(c.shuflen - 1)
 
+	retry := c.fails[q.Id()] > 0
 	c.neighbsmu.Unlock()
 
+	if retry {
+		c.count(func(s *ShuffleStats) { s.Retries++ })
+	}
+
 	// Calling another cyclon over the network can take a while
 	// so we keep our cache unlocked while doing this.
 	var answer []pnet.Peer
-	conn, err := c.protonet.Dial(q)
+	ctx, cancel := clock.WithTimeout(context.Background(), c.Clock, ShuffleTimeout)
+	rtt, err := c.call(ctx, q, "CyclonRPC.HandleShuffle", append(offer, c.me), &answer)
+	cancel()
+
 	if err == nil {
-		cl := rpc.NewClient(conn)
-		cl.Call("CyclonRPC.HandleShuffle", append(offer, c.me), &answer)
-		conn.Close()
+		c.recordLatency(q, rtt)
+		c.neighbsmu.Lock()
+		delete(c.fails, q.Id())
+		c.updateCache(answer, offer)
+		c.neighbsmu.Unlock()
+		c.count(func(s *ShuffleStats) { s.Succeeded++ })
+		return
 	}
 
+	// Our offer is kept, since it never reached anyone. q goes back
+	// where PopOldest took it from, unless it's failed too often, or
+	// another shuffle brought it back or filled the cache meanwhile.
 	c.neighbsmu.Lock()
-	c.updateCache(answer, offer)
+	id := q.Id()
+	fails := c.fails[id] + 1
+	_, has := c.neighbs[id]
+	dropped := false
+	switch {
+	case has:
+		delete(c.fails, id)
+	case fails > ShuffleRetries || len(c.neighbs) >= c.cachesize:
+		delete(c.fails, id)
+		dropped = true
+	default:
+		c.fails[id] = fails
+		c.neighbs[id] = q
+	}
 	c.neighbsmu.Unlock()
+
+	c.count(func(s *ShuffleStats) {
+		s.Failed++
+		if err == context.DeadlineExceeded {
+			s.TimedOut++
+		}
+		if dropped {
+			s.Dropped++
+		}
+	})
+}
+
+// ShuffleStats counts how the shuffles that a Cyclon initiated went.
+type ShuffleStats struct {
+	Succeeded int // shuffles that got an answer
+	Failed    int // shuffles that didn't
+	Retries   int // shuffles with a neighbour that failed the one before
+	Dropped   int // neighbours dropped for failing, see ShuffleRetries
+	TimedOut  int // failed shuffles that didn't get an answer in time
+}
+
+// Stats returns the counts of the shuffles so far.
+func (c *Cyclon) Stats() ShuffleStats {
+	c.statsmu.Lock()
+	defer c.statsmu.Unlock()
+	return c.stats
+}
+
+func (c *Cyclon) count(f func(*ShuffleStats)) {
+	c.statsmu.Lock()
+	f(&c.stats)
+	c.statsmu.Unlock()
+}
+
+// recordLatency adds a round trip time sample of p to the peerstore, if
+// the protonet has one.
+func (c *Cyclon) recordLatency(p pnet.Peer, d time.Duration) {
+	pp, ok := c.protonet.(pnet.PeerstoreProvider)
+	if !ok {
+		return
+	}
+	if id, ok := p.Id().(string); ok {
+		pp.Peerstore().RecordLatency(id, d)
+	}
+}
+
+// call dials p and makes a single RPC, all before ctx is done, and returns
+// how long the RPC took.
+func (c *Cyclon) call(ctx context.Context, p pnet.Peer, method string, args, reply interface{}) (time.Duration, error) {
+	dctx, cancel := clock.WithTimeout(ctx, c.Clock, DialTimeout)
+	conn, err := c.protonet.DialContext(dctx, p)
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	cl := rpc.NewClient(conn)
+	defer cl.Close()
+
+	// A peer can accept and then stall, so closing the connection is the
+	// only way to get the call back once ctx is done
+	start := c.Clock.Now()
+	done := make(chan error, 1)
+	go func() { done <- cl.Call(method, args, reply) }()
+	select {
+	case err = <-done:
+		return c.Clock.Now().Sub(start), err
+	case <-ctx.Done():
+		conn.Close()
+		<-done
+		return 0, ctx.Err()
+	}
+}
+
+// walkTimeout bounds a walk with the given hops left.
+func walkTimeout(hops int) time.Duration {
+	return time.Duration(hops+1) * ShuffleTimeout
 }
 
 type CyclonRPC struct{ c *Cyclon }
 
+// Walk is a random walk of a joining peer.
+type Walk struct {
+	Joiner pnet.Peer
+	Hops   int // left to take
+}
+
+// HandleWalk passes the walk on to a random neighbour, until it has no
+// hops left. Then the joiner takes the place of a random cache entry,
+// which is answered. If the cache isn't full yet, nothing is replaced and
+// the answer is us.
+func (r CyclonRPC) HandleWalk(w Walk, answer *pnet.Peer) error {
+	c := r.c
+
+	if w.Hops > 0 {
+		c.neighbsmu.RLock()
+		next := c.neighbs.Sample(1)
+		c.neighbsmu.RUnlock()
+
+		// If the next hop fails, the walk ends here
+		if len(next) > 0 && next[0].Id() != w.Joiner.Id() {
+			w.Hops--
+			ctx, cancel := clock.WithTimeout(context.Background(), c.Clock, walkTimeout(w.Hops))
+			_, err := c.call(ctx, next[0], "CyclonRPC.HandleWalk", w, answer)
+			cancel()
+			if err == nil {
+				return nil
+			}
+		}
+	}
+
+	c.neighbsmu.Lock()
+	defer c.neighbsmu.Unlock()
+
+	if _, has := c.neighbs[w.Joiner.Id()]; has || w.Joiner.Id() == c.me.Id() {
+		return errors.New("the walk ended at a peer that knows the joiner")
+	}
+
+	w.Joiner.Put(age, 0)
+	if len(c.neighbs) < c.cachesize {
+		c.updateCache([]pnet.Peer{w.Joiner}, nil)
+		*answer = c.me
+		return nil
+	}
+	old := c.neighbs.Sample(1)
+	c.updateCache([]pnet.Peer{w.Joiner}, old)
+	*answer = old[0]
+	return nil
+}
+
 func (r CyclonRPC) HandleShuffle(offer []pnet.Peer, answer *[]pnet.Peer) error {
 	c := r.c
 	c.neighbsmu.Lock()
@@ -170,29 +488,61 @@ func (r CyclonRPC) serve() chan bool {
 	// to dialers running the Cyclon protocol.
 	ln := r.c.protonet.Listen()
 
+	// The connections being served are closed on stop, along with the
+	// listener
+	var connsmu sync.Mutex
+	conns := make(map[io.ReadWriteCloser]bool)
+
 	stop := make(chan bool)
+	r.c.running.Add(1)
 	go func() {
+		defer r.c.running.Done()
 		<-stop
 		ln.Close()
+		connsmu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		conns = nil
+		connsmu.Unlock()
 	}()
 
 	// Run an rpc server to handle shuffle calls
 	s := rpc.NewServer()
 	s.Register(r)
+	r.c.running.Add(1)
 	go func() {
+		defer r.c.running.Done()
 		for {
 			conn, err := ln.Accept()
 			if err != nil {
 				break
 			}
-			go s.ServeConn(conn)
+
+			connsmu.Lock()
+			if conns == nil {
+				connsmu.Unlock()
+				conn.Close()
+				break
+			}
+			conns[conn] = true
+			r.c.running.Add(1)
+			connsmu.Unlock()
+
+			go func() {
+				defer r.c.running.Done()
+				s.ServeConn(conn)
+				connsmu.Lock()
+				delete(conns, conn)
+				connsmu.Unlock()
+			}()
 		}
 	}()
 
 	return stop
 }
 
-func (c Cyclon) updateCache(new, old []pnet.Peer) {
+func (c *Cyclon) updateCache(new, old []pnet.Peer) {
 	// Filter out entries that are already in the cache or equal to c.me
 	for i := 0; i < len(new); i++ {
 		if _, has := c.neighbs[new[i].Id()]; has || c.me.Id() == new[i].Id() {
@@ -202,11 +552,16 @@ func (c Cyclon) updateCache(new, old []pnet.Peer) {
 		}
 	}
 
-	// Send the new peers out without blocking
+	// Send copies of the new peers out without blocking, so that aging
+	// them here doesn't race with whoever reads them
 	if c.outBuf != nil {
 		for _, p := range new {
 			p.Put(bday, c.serviceAge-int64(p.Get(age).(int)))
-			c.outBuf <- p
+			if cp, ok := p.(pnet.Copier); ok {
+				c.outBuf <- cp.Copy()
+			} else {
+				c.outBuf <- p
+			}
 		}
 	}
 
@@ -222,6 +577,7 @@ func (c Cyclon) updateCache(new, old []pnet.Peer) {
 		// we're replacing entries rather than pushing new ones.
 		if _, has := c.neighbs[old[0].Id()]; has {
 			delete(c.neighbs, old[0].Id())
+			delete(c.fails, old[0].Id())
 			c.neighbs[new[0].Id()] = new[0]
 			new = new[1:]
 		}
@@ -3,11 +3,13 @@ package cyclon
 import (
 	"encoding/gob"
 	"fmt"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/Gaboose/go-pubsub/clock"
 	"github.com/Gaboose/go-pubsub/pnet"
 	"github.com/Gaboose/go-pubsub/pnet/mock"
 )
@@ -45,7 +47,9 @@ func TestNoAnswer(t *testing.T) {
 
 	gob.Register(&mock.Peer{})
 	c.Add(&mock.Peer{ID: "peer1"})
-	c.Shuffle()
+	for i := 0; i <= ShuffleRetries; i++ {
+		c.Shuffle()
+	}
 
 	if len(c.neighbs) > 0 {
 		t.Fatalf("expected no neighbours, got %v", c.neighbs)
@@ -63,7 +67,10 @@ func TestAgeSelect(t *testing.T) {
 		"peer3": &mock.Peer{"peer3", map[string]interface{}{age: 3}},
 	}
 
-	c.Shuffle()
+	// The oldest is tried every time, until it's dropped
+	for i := 0; i <= ShuffleRetries; i++ {
+		c.Shuffle()
+	}
 
 	expected := []interface{}{"peer1", "peer3"}
 	got := make([]interface{}, 0, 3)
@@ -216,6 +223,360 @@ func TestBday(t *testing.T) {
 	}
 }
 
+func TestPartition(t *testing.T) {
+	n := mock.NewNetwork(1)
+	n.SetDefaultLink(mock.Link{Latency: 10 * time.Millisecond})
+	p0 := &mock.Peer{ID: "p0"}
+	p1 := &mock.Peer{ID: "p1"}
+	c0 := New(p0, 20, 10, n.DialListener(p0.Id(), Proto))
+	c1 := New(p1, 20, 10, n.DialListener(p1.Id(), Proto))
+
+	gob.Register(&mock.Peer{})
+	c1.Start(0)
+	defer c1.Stop()
+
+	// Across a partition, the neighbour is dropped like an unresponsive one
+	n.Partition([]interface{}{"p0"})
+	c0.Add(p1)
+	for i := 0; i <= ShuffleRetries; i++ {
+		c0.Shuffle()
+	}
+	if len(c0.neighbs) > 0 {
+		t.Fatalf("expected no neighbours, got %v", c0.neighbs)
+	}
+
+	// Once healed, shuffling goes through despite the latency
+	n.Heal()
+	c0.Add(p1)
+	c0.Shuffle()
+	select {
+	case p := <-c1.Out():
+		if p.Id() != p0.Id() {
+			t.Fatalf("expected %v, got %v", p0, p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestTick(t *testing.T) {
+	c := clock.NewFake(time.Unix(0, 0))
+	sw := mock.ProtoNetSwarm{}
+	p0 := &mock.Peer{ID: "p0"}
+	p1 := &mock.Peer{ID: "p1"}
+	c0 := New(p0, 20, 10, sw.DialListener(p0.Id()))
+	c0.Clock = c
+	c1 := New(p1, 20, 10, sw.DialListener(p1.Id()))
+
+	gob.Register(&mock.Peer{})
+	c1.Start(0)
+	defer c1.Stop()
+	c0.Add(p1)
+	c0.Start(time.Hour)
+	defer c0.Stop()
+
+	// Nothing happens until an hour has passed on the clock
+	c.BlockUntil(1)
+	select {
+	case p := <-c1.Out():
+		t.Fatalf("expected no shuffle yet, got %v", p)
+	default:
+	}
+
+	c.Advance(time.Hour)
+	select {
+	case p := <-c1.Out():
+		if p.Id() != p0.Id() {
+			t.Fatalf("expected %v, got %v", p0, p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestCrash(t *testing.T) {
+	sw := mock.ProtoNetSwarm{}
+	p0 := &mock.Peer{ID: "p0"}
+	p1 := &mock.Peer{ID: "p1"}
+	p2 := &mock.Peer{ID: "p2"}
+	c0 := New(p0, 20, 10, sw.DialListener(p0.Id()))
+	c1 := New(p1, 20, 10, sw.DialListener(p1.Id()))
+	c2 := New(p2, 20, 10, sw.DialListener(p2.Id()))
+
+	gob.Register(&mock.Peer{})
+	c1.Start(0)
+	defer c1.Stop()
+	c2.Start(0)
+	defer c2.Stop()
+	c0.neighbs = PeerSet{
+		"p1": &mock.Peer{"p1", map[string]interface{}{age: 10}},
+		"p2": &mock.Peer{"p2", map[string]interface{}{age: 0}},
+	}
+
+	// The crashed neighbour is dropped once it's out of retries, the
+	// other one is kept
+	sw.Kill("p1", mock.Crash)
+	for i := 0; i <= ShuffleRetries; i++ {
+		c0.Shuffle()
+	}
+	if _, ok := c0.neighbs["p1"]; ok {
+		t.Fatalf("expected p1 to be dropped, got %v", c0.neighbs)
+	}
+	if _, ok := c0.neighbs["p2"]; !ok {
+		t.Fatalf("expected p2 to be kept, got %v", c0.neighbs)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	sw := mock.ProtoNetSwarm{}
+	gob.Register(&mock.Peer{})
+
+	// A ring where everyone knows the next three
+	n := 8
+	cs := make([]*Cyclon, n)
+	for i := range cs {
+		p := &mock.Peer{ID: fmt.Sprintf("p%d", i)}
+		cs[i] = New(p, 3, 2, sw.DialListener(p.Id()))
+	}
+	for i, c := range cs {
+		for j := 1; j <= 3; j++ {
+			id := fmt.Sprintf("p%d", (i+j)%n)
+			c.neighbs[id] = &mock.Peer{id, map[string]interface{}{age: 0}}
+		}
+		c.Start(0)
+		defer c.Stop()
+	}
+
+	pj := &mock.Peer{ID: "pj"}
+	cj := New(pj, 3, 2, sw.DialListener(pj.Id()))
+	err := cj.Join(&mock.Peer{ID: "p0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The caches stay full, and we're in one of them for each walk that
+	// ended somewhere. Two walks can bring us the same entry, so we may
+	// have fewer.
+	if len(cj.neighbs) == 0 {
+		t.Fatal("expected neighbours")
+	}
+	in := 0
+	for _, c := range cs {
+		if len(c.neighbs) != 3 {
+			t.Fatalf("expected %v to have 3 neighbours, got %v", c.me.Id(), c.neighbs)
+		}
+		if _, ok := c.neighbs["pj"]; ok {
+			in++
+		}
+	}
+	if in < len(cj.neighbs) || in > 3 {
+		t.Fatalf("expected to be in %d to 3 caches, got %d", len(cj.neighbs), in)
+	}
+}
+
+func TestJoinAlone(t *testing.T) {
+	sw := mock.ProtoNetSwarm{}
+	gob.Register(&mock.Peer{})
+	p0 := &mock.Peer{ID: "p0"}
+	p1 := &mock.Peer{ID: "p1"}
+	c0 := New(p0, 3, 2, sw.DialListener(p0.Id()))
+	c1 := New(p1, 3, 2, sw.DialListener(p1.Id()))
+	c0.Start(0)
+	defer c0.Stop()
+
+	// The introducer knows nobody, so the walks end there, and the two
+	// get to know each other
+	err := c1.Join(p0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c1.neighbs["p0"]; !ok || len(c1.neighbs) != 1 {
+		t.Fatalf("expected p0, got %v", c1.neighbs)
+	}
+	if _, ok := c0.neighbs["p1"]; !ok || len(c0.neighbs) != 1 {
+		t.Fatalf("expected p1, got %v", c0.neighbs)
+	}
+
+	// An introducer that's down is simply added
+	c2 := New(&mock.Peer{ID: "p2"}, 3, 2, sw.DialListener("p2"))
+	err = c2.Join(&mock.Peer{ID: "p3"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, ok := c2.neighbs["p3"]; !ok {
+		t.Fatalf("expected p3, got %v", c2.neighbs)
+	}
+}
+
+func TestCache(t *testing.T) {
+	c := clock.NewFake(time.Unix(0, 0))
+	sw := mock.ProtoNetSwarm{}
+	path := filepath.Join(t.TempDir(), "cache")
+	gob.Register(&mock.Peer{})
+
+	c0 := New(&mock.Peer{ID: "p0"}, 20, 10, sw.DialListener("p0"))
+	c0.Clock = c
+	c0.Cachefile = path
+	c0.neighbs = PeerSet{
+		"p1": &mock.Peer{"p1", map[string]interface{}{age: 2}},
+		"p2": &mock.Peer{"p2", map[string]interface{}{age: 5}},
+	}
+	c0.Start(time.Minute)
+	c0.Stop()
+
+	// Three minutes later, the peers have missed three shuffles
+	c.Advance(3 * time.Minute)
+	c1 := New(&mock.Peer{ID: "p0"}, 20, 10, sw.DialListener("p0"))
+	c1.Clock = c
+	c1.Cachefile = path
+	c1.Start(time.Minute)
+	defer c1.Stop()
+
+	expected := map[string]int{"p1": 5, "p2": 8}
+	for i := 0; i < len(expected); i++ {
+		select {
+		case p := <-c1.Out():
+			if a := p.Get(age); a != expected[p.Id().(string)] {
+				t.Fatalf("expected %v.age %d, got %v", p.Id(), expected[p.Id().(string)], a)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out")
+		}
+	}
+	if len(c1.Neighbours()) != 2 {
+		t.Fatalf("expected 2 neighbours, got %v", c1.Neighbours())
+	}
+
+	// A missing file loads nothing
+	err := c1.Load(path + ".missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveWhileShuffling(t *testing.T) {
+	sw := mock.ProtoNetSwarm{}
+	path := filepath.Join(t.TempDir(), "cache")
+	gob.Register(&mock.Peer{})
+
+	c0 := New(&mock.Peer{ID: "p0"}, 20, 10, sw.DialListener("p0"))
+	for i := 1; i <= 20; i++ {
+		id := fmt.Sprintf("p%d", i)
+		c0.neighbs[id] = &mock.Peer{id, map[string]interface{}{age: 0}}
+	}
+
+	// Shuffles age the peers while they're saved, which the race detector
+	// catches if the saving doesn't hold the lock
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 10; i++ {
+			c0.Shuffle()
+		}
+		close(done)
+	}()
+	for i := 0; i < 10; i++ {
+		err := c0.Save(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestStall(t *testing.T) {
+	defer func(n int) { ShuffleRetries = n }(ShuffleRetries)
+	ShuffleRetries = 0
+
+	c := clock.NewFake(time.Unix(0, 0))
+	sw := mock.ProtoNetSwarm{}
+	p0 := &mock.Peer{ID: "p0"}
+	p1 := &mock.Peer{ID: "p1"}
+	c0 := New(p0, 20, 10, sw.DialListener(p0.Id()))
+	c0.Clock = c
+	c1 := New(p1, 20, 10, sw.DialListener(p1.Id()))
+
+	gob.Register(&mock.Peer{})
+	c1.Start(0)
+	defer c1.Stop()
+
+	// A neighbour that accepts and then stalls is dropped in time
+	sw.Kill("p1", mock.Freeze)
+	c0.Add(p1)
+	done := make(chan bool)
+	go func() {
+		c0.Shuffle()
+		close(done)
+	}()
+	c.BlockUntil(1)
+	c.Advance(ShuffleTimeout)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+	if len(c0.neighbs) > 0 {
+		t.Fatalf("expected no neighbours, got %v", c0.neighbs)
+	}
+	expected := ShuffleStats{Failed: 1, Dropped: 1, TimedOut: 1}
+	if s := c0.Stats(); s != expected {
+		t.Fatalf("expected %+v, got %+v", expected, s)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	defer func(n int) { ShuffleRetries = n }(ShuffleRetries)
+	ShuffleRetries = 1
+
+	sw := mock.ProtoNetSwarm{}
+	p0 := &mock.Peer{ID: "p0"}
+	p2 := &mock.Peer{ID: "p2"}
+	c0 := New(p0, 20, 10, sw.DialListener(p0.Id()))
+	c2 := New(p2, 20, 10, sw.DialListener(p2.Id()))
+
+	gob.Register(&mock.Peer{})
+	c2.Start(0)
+	defer c2.Stop()
+
+	// The oldest neighbour isn't there. It survives a failed shuffle...
+	c0.neighbs = PeerSet{
+		"p1": &mock.Peer{"p1", map[string]interface{}{age: 10}},
+		"p2": &mock.Peer{"p2", map[string]interface{}{age: 0}},
+	}
+	c0.Shuffle()
+	if _, ok := c0.neighbs["p1"]; !ok {
+		t.Fatalf("expected p1 to be kept, got %v", c0.neighbs)
+	}
+	expected := ShuffleStats{Failed: 1}
+	if s := c0.Stats(); s != expected {
+		t.Fatalf("expected %+v, got %+v", expected, s)
+	}
+
+	// ...and is dropped when the retry fails too
+	c0.Shuffle()
+	if _, ok := c0.neighbs["p1"]; ok {
+		t.Fatalf("expected p1 to be dropped, got %v", c0.neighbs)
+	}
+	expected = ShuffleStats{Failed: 2, Retries: 1, Dropped: 1}
+	if s := c0.Stats(); s != expected {
+		t.Fatalf("expected %+v, got %+v", expected, s)
+	}
+
+	// The next oldest gets its turn then
+	c0.Shuffle()
+	expected.Succeeded++
+	if s := c0.Stats(); s != expected {
+		t.Fatalf("expected %+v, got %+v", expected, s)
+	}
+	select {
+	case p := <-c2.Out():
+		if p.Id() != p0.Id() {
+			t.Fatalf("expected %v, got %v", p0, p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+}
+
 func equalSets(arr1, arr2 []interface{}) bool {
 	set1 := map[interface{}]bool{}
 	for _, s := range arr1 {